@@ -6,6 +6,13 @@ ISUCON13_MYSQL_DIALCONFIG_DATABASE="isupipe"
 ISUCON13_MYSQL_DIALCONFIG_PARSETIME="true"
 ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS="35.74.152.186"
 ISUCON13_POWERDNS_DISABLED="false"
+ISUCON13_POWERDNS_MYSQL_ADDRESS="isucon3"
+ISUCON13_BCRYPT_COST="10"
+ISUCON13_RESERVATION_SLOT_SECONDS="3600"
+ISUCON13_RESERVATION_SLOT_CAPACITY="5"
+# 予約期間 (RFC3339) アプリケーションとinit.shの両方が読む
+ISUCON13_RESERVATION_TERM_START_AT="2023-11-25T01:00:00Z"
+ISUCON13_RESERVATION_TERM_END_AT="2024-11-25T01:00:00Z"
 
 GOGC=300
 
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const adminTokenEnvKey = "ISUCON13_ADMIN_TOKEN"
+
+// 空のときは管理APIを無効にする
+var adminToken = os.Getenv(adminTokenEnvKey)
+
+// 管理APIは Authorization: Bearer <ISUCON13_ADMIN_TOKEN> で認証する
+func verifyAdmin(c echo.Context) error {
+	if adminToken == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "admin API is disabled")
+	}
+
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid admin token")
+	}
+
+	return nil
+}
@@ -106,6 +106,11 @@ func bulkFillUserResponse(ctx context.Context, db sqlx.QueryerContext, userModel
 		return nil, fmt.Errorf("failed to get icon hash by ids: %w", err)
 	}
 
+	followerCountByUserId, followingCountByUserId, err := bulkGetFollowCounts(ctx, db, userIds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get follow counts: %w", err)
+	}
+
 	// User.ID -> User にして返す
 	userById := make(map[int64]User)
 	for _, userModel := range userModels {
@@ -121,7 +126,9 @@ func bulkFillUserResponse(ctx context.Context, db sqlx.QueryerContext, userModel
 				ID:       themeModel.ID,
 				DarkMode: themeModel.DarkMode,
 			},
-			IconHash: iconHash,
+			IconHash:       iconHash,
+			FollowerCount:  followerCountByUserId[userModel.ID],
+			FollowingCount: followingCountByUserId[userModel.ID],
 		}
 		userById[user.ID] = user
 	}
@@ -158,8 +165,37 @@ func bulkGetTagsByLivestream(ctx context.Context, db sqlx.QueryerContext, livest
 	for _, livestreamModel := range livestreamModels {
 		tagsByLivestreamId[livestreamModel.ID] = make([]Tag, 0)
 	}
+
+	// 他のホストで作成されたばかりのタグはキャッシュにないので、DBから引く
+	tagByID := make(map[int64]Tag, len(tagIds))
+	var missingTagIds []int64
+	for _, tagId := range tagIds {
+		if tag, ok := tagCache.Get(tagId); ok {
+			tagByID[tagId] = tag
+		} else {
+			missingTagIds = append(missingTagIds, tagId)
+		}
+	}
+	if len(missingTagIds) > 0 {
+		var tagModels []*TagModel
+		query, args, err := sqlx.In("SELECT * FROM tags WHERE id IN (?)", missingTagIds)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct IN query for tags: %w", err)
+		}
+		if err := sqlx.SelectContext(ctx, db, &tagModels, query, args...); err != nil {
+			return nil, fmt.Errorf("failed to get tags: %w", err)
+		}
+		for _, tagModel := range tagModels {
+			tagByID[tagModel.ID] = Tag{ID: tagModel.ID, Name: tagModel.Name}
+		}
+	}
+
 	for _, livestreamTagModel := range livestreamTagModels {
-		tag := *tagsAll[livestreamTagModel.TagID]
+		tag, ok := tagByID[livestreamTagModel.TagID]
+		if !ok {
+			// 削除されたタグは表示しない
+			continue
+		}
 		tagsByLivestreamId[livestreamTagModel.LivestreamID] = append(tagsByLivestreamId[livestreamTagModel.LivestreamID], tag)
 	}
 
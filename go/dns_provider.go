@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	powerDNSDisabledEnvKey      = "ISUCON13_POWERDNS_DISABLED"
+	powerDNSMySQLAddressEnvKey  = "ISUCON13_POWERDNS_MYSQL_ADDRESS"
+	powerDNSMySQLPortEnvKey     = "ISUCON13_POWERDNS_MYSQL_PORT"
+	powerDNSMySQLUserEnvKey     = "ISUCON13_POWERDNS_MYSQL_USER"
+	powerDNSMySQLPasswordEnvKey = "ISUCON13_POWERDNS_MYSQL_PASSWORD"
+	powerDNSMySQLDatabaseEnvKey = "ISUCON13_POWERDNS_MYSQL_DATABASE"
+
+	// ユーザごとのサブドメインを管理するゾーン
+	powerDNSZone = "u.isucon.dev"
+
+	// 複数のホストで同時に突き合わせないためのロック名 (GET_LOCK)
+	powerDNSReconcileLockName = "dns-reconcile"
+)
+
+// ユーザのサブドメイン (<name>.u.isucon.dev) のAレコードを管理する
+type DNSProvider interface {
+	// Aレコードを作成する (既にあれば置き換える)
+	AddRecord(ctx context.Context, name string, address string) error
+	// Aレコードを削除する (なければ何もしない)
+	DeleteRecord(ctx context.Context, name string) error
+	// ゾーン内のAレコードの一覧 (ゾーンからの相対名 -> アドレス)
+	ListRecords(ctx context.Context) (map[string]string, error)
+}
+
+var dnsProvider DNSProvider = NoopDNSProvider{}
+
+// PowerDNSを使わない環境向けに、何もしないプロバイダ
+type NoopDNSProvider struct{}
+
+func (NoopDNSProvider) AddRecord(ctx context.Context, name string, address string) error {
+	return nil
+}
+
+func (NoopDNSProvider) DeleteRecord(ctx context.Context, name string) error {
+	return nil
+}
+
+func (NoopDNSProvider) ListRecords(ctx context.Context) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+// PowerDNSのgmysqlバックエンドのテーブルに直接書き込むプロバイダ
+// pdns.confのgmysql-*と同じDBを指すこと
+type PowerDNSMySQLProvider struct {
+	db *sqlx.DB
+}
+
+func (p *PowerDNSMySQLProvider) AddRecord(ctx context.Context, name string, address string) error {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// recordsには一意制約がないので、ゾーンの行をロックして同じ名前の追加を直列化する
+	// (同時にDELETE・INSERTすると、Aレコードが重複する)
+	var domainID int64
+	if err := tx.GetContext(ctx, &domainID, "SELECT id FROM domains WHERE name = ? FOR UPDATE", powerDNSZone); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("zone %s not found", powerDNSZone)
+		}
+		return fmt.Errorf("failed to get zone: %w", err)
+	}
+
+	fqdn := name + "." + powerDNSZone
+	if _, err := tx.ExecContext(ctx, "DELETE FROM records WHERE name = ? AND type = 'A' AND domain_id = ?", fqdn, domainID); err != nil {
+		return fmt.Errorf("failed to delete old record: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO records (domain_id, name, type, content, ttl, prio, disabled, auth) VALUES (?, ?, 'A', ?, 0, 0, 0, 1)", domainID, fqdn, address); err != nil {
+		return fmt.Errorf("failed to insert record: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (p *PowerDNSMySQLProvider) DeleteRecord(ctx context.Context, name string) error {
+	fqdn := name + "." + powerDNSZone
+	if _, err := p.db.ExecContext(ctx, "DELETE FROM records WHERE name = ? AND type = 'A' AND domain_id = (SELECT id FROM domains WHERE name = ?)", fqdn, powerDNSZone); err != nil {
+		return fmt.Errorf("failed to delete record: %w", err)
+	}
+	return nil
+}
+
+func (p *PowerDNSMySQLProvider) ListRecords(ctx context.Context) (map[string]string, error) {
+	type record struct {
+		Name    string `db:"name"`
+		Content string `db:"content"`
+	}
+	var records []record
+	if err := p.db.SelectContext(ctx, &records, "SELECT name, content FROM records WHERE type = 'A' AND domain_id = (SELECT id FROM domains WHERE name = ?)", powerDNSZone); err != nil {
+		return nil, fmt.Errorf("failed to get records: %w", err)
+	}
+
+	suffix := "." + powerDNSZone
+	addressByName := make(map[string]string, len(records))
+	for _, r := range records {
+		name := strings.ToLower(r.Name)
+		// ゾーン自体のレコードはユーザのものではない
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		addressByName[strings.TrimSuffix(name, suffix)] = r.Content
+	}
+	return addressByName, nil
+}
+
+// 突き合わせのロックを取る (他のホストが取っていれば待たずにfalseを返す)
+// GET_LOCKは接続ごとのロックなので、解放するまで接続を持っておく
+func (p *PowerDNSMySQLProvider) LockReconcile(ctx context.Context) (func(), bool, error) {
+	conn, err := p.db.Connx(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	var locked sql.NullInt64
+	if err := conn.GetContext(ctx, &locked, "SELECT GET_LOCK(?, 0)", powerDNSReconcileLockName); err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("failed to get lock: %w", err)
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, false, nil
+	}
+	return func() {
+		// 接続を閉じればロックも外れる
+		conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", powerDNSReconcileLockName)
+		conn.Close()
+	}, true, nil
+}
+
+// ISUCON13_POWERDNS_DISABLEDがtrueならNoopDNSProviderを返す
+func newDNSProvider() (DNSProvider, error) {
+	if v, ok := os.LookupEnv(powerDNSDisabledEnvKey); ok {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", powerDNSDisabledEnvKey, err)
+		}
+		if disabled {
+			return NoopDNSProvider{}, nil
+		}
+	}
+
+	// デフォルト値はpdns.confのgmysql-*と同じ
+	conf := mysql.NewConfig()
+	conf.Net = "tcp"
+	conf.Addr = net.JoinHostPort("127.0.0.1", "3306")
+	conf.User = "isudns"
+	conf.Passwd = "isudns"
+	conf.DBName = "isudns"
+	conf.InterpolateParams = true
+
+	if addr, ok := os.LookupEnv(powerDNSMySQLAddressEnvKey); ok {
+		if port, ok2 := os.LookupEnv(powerDNSMySQLPortEnvKey); ok2 {
+			conf.Addr = net.JoinHostPort(addr, port)
+		} else {
+			conf.Addr = net.JoinHostPort(addr, "3306")
+		}
+	}
+	if v, ok := os.LookupEnv(powerDNSMySQLUserEnvKey); ok {
+		conf.User = v
+	}
+	if v, ok := os.LookupEnv(powerDNSMySQLPasswordEnvKey); ok {
+		conf.Passwd = v
+	}
+	if v, ok := os.LookupEnv(powerDNSMySQLDatabaseEnvKey); ok {
+		conf.DBName = v
+	}
+
+	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &PowerDNSMySQLProvider{db: db}, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	dnsReconcileIntervalSecondsEnvKey = "ISUCON13_DNS_RECONCILE_INTERVAL_SECONDS"
+
+	maxDNSLabelLength = 63
+)
+
+// ユーザとゾーンのレコードを突き合わせる間隔
+var dnsReconcileInterval = 5 * time.Minute
+
+func loadDNSReconcileInterval() (time.Duration, error) {
+	v, ok := os.LookupEnv(dnsReconcileIntervalSecondsEnvKey)
+	if !ok {
+		return dnsReconcileInterval, nil
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("environment variable '%s' must be positive integer", dnsReconcileIntervalSecondsEnvKey)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+type DNSReconcileResult struct {
+	Added   []string
+	Updated []string
+	Deleted []string
+	// 他のホストが突き合わせ中だった
+	Skipped bool
+}
+
+// 複数のホストで同時に突き合わせないよう、ロックを取れるプロバイダ
+type dnsReconcileLocker interface {
+	LockReconcile(ctx context.Context) (unlock func(), locked bool, err error)
+}
+
+// ユーザのサブドメインのAレコードをusersに合わせる
+//   - レコードのないユーザには作る (アドレスが違えば作り直す)
+//   - ユーザのいないレコードは消す
+//   - ゾーンファイルに書かれた名前には触らない
+func reconcileDNSRecords(ctx context.Context) (DNSReconcileResult, error) {
+	var result DNSReconcileResult
+
+	if locker, ok := dnsProvider.(dnsReconcileLocker); ok {
+		unlock, locked, err := locker.LockReconcile(ctx)
+		if err != nil {
+			return result, err
+		}
+		if !locked {
+			result.Skipped = true
+			return result, nil
+		}
+		defer unlock()
+	}
+
+	// 登録・退会の途中のユーザを取りこぼさないよう、レコードを先に引く
+	// (後から登録されたユーザは作成済みでも作り直すだけで、退会したユーザは消えている)
+	addressByName, err := dnsProvider.ListRecords(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	var names []string
+	if err := dbConn.SelectContext(ctx, &names, "SELECT name FROM users WHERE deleted_at IS NULL"); err != nil {
+		return result, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	userNames := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		// サブドメインにできない名前はレコードを作らない
+		if !isDNSLabel(name) || staticZone.Has(name) {
+			continue
+		}
+		userNames[name] = true
+
+		address, ok := addressByName[name]
+		if ok && address == powerDNSSubdomainAddress {
+			continue
+		}
+		if err := dnsProvider.AddRecord(ctx, name, powerDNSSubdomainAddress); err != nil {
+			return result, err
+		}
+		if ok {
+			result.Updated = append(result.Updated, name)
+		} else {
+			result.Added = append(result.Added, name)
+		}
+	}
+
+	for name := range addressByName {
+		if userNames[name] || staticZone.Has(name) {
+			continue
+		}
+		if err := dnsProvider.DeleteRecord(ctx, name); err != nil {
+			return result, err
+		}
+		result.Deleted = append(result.Deleted, name)
+	}
+
+	return result, nil
+}
+
+func isDNSLabel(name string) bool {
+	return dnsLabelViolation(name) == ""
+}
+
+// 英数字とハイフンからなる63文字以内のラベル (先頭と末尾はハイフン不可) として使えない理由
+// 使える場合は空文字列を返す
+func dnsLabelViolation(name string) string {
+	if len(name) == 0 {
+		return UsernameReasonEmpty
+	}
+	if len(name) > maxDNSLabelLength {
+		return UsernameReasonTooLong
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return UsernameReasonInvalidCharacter
+		}
+	}
+	if strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+		return UsernameReasonInvalidHyphen
+	}
+	return ""
+}
+
+// 起動時と、dnsReconcileIntervalごとに突き合わせる
+func startDNSReconciler(logger echo.Logger) {
+	// 組み込みDNSサーバはusersから直接キャッシュを作り直す
+	switch dnsProvider.(type) {
+	case NoopDNSProvider, *EmbeddedDNSProvider:
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(dnsReconcileInterval)
+		defer ticker.Stop()
+		for {
+			result, err := reconcileDNSRecords(context.Background())
+			if err != nil {
+				logger.Errorf("failed to reconcile dns records: %v", err)
+			} else if len(result.Added)+len(result.Updated)+len(result.Deleted) > 0 {
+				logger.Infof("reconciled dns records: added=%v updated=%v deleted=%v", result.Added, result.Updated, result.Deleted)
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsServerEnabledEnvKey                    = "ISUCON13_DNS_SERVER_ENABLED"
+	dnsServerAddressEnvKey                    = "ISUCON13_DNS_SERVER_ADDRESS"
+	dnsServerNXDomainDelayMillisEnvKey        = "ISUCON13_DNS_SERVER_NXDOMAIN_DELAY_MILLISECONDS"
+	dnsServerCacheRefreshSecondsEnvKey        = "ISUCON13_DNS_SERVER_CACHE_REFRESH_SECONDS"
+	dnsServerTCPTimeout                       = 10 * time.Second
+	dnsServerLookupTimeout                    = 2 * time.Second
+	dnsServerNegativeCacheTTL                 = time.Second
+	dnsServerMaxUDPMessageSize                = 512
+	dnsServerUserRecordTTL             uint32 = 0
+)
+
+// dnsdist.confのRegexRuleでDropActionされる名前
+var dnsServerDropRegexp = regexp.MustCompile(`[a-zA-Z0-9]+\.[a-zA-Z0-9]+\.u\.isucon\.dev$`)
+
+// 組み込みDNSサーバの設定
+// 有効にするとPowerDNSの代わりに、このプロセスがu.isucon.devの権威サーバになる
+type DNSServerConfig struct {
+	Enabled bool
+	// UDP・TCPで待ち受けるアドレス
+	// デフォルトはdnsdistの転送先 (pdns.confのlocal-port) で、PowerDNSを止めて置き換える
+	// dnsdistを通さずに53番で受ける場合は、unitにAmbientCapabilities=CAP_NET_BIND_SERVICEが必要
+	Address string
+	// NXDOMAINを返すまでの遅延
+	// dnsdistを通す場合はdnsdistのDelayResponseActionが遅らせるので0、通さない場合は300msにする
+	NXDomainDelay time.Duration
+	// usersからキャッシュを作り直す間隔 (他のサーバで退会したユーザを反映するため)
+	CacheRefreshInterval time.Duration
+}
+
+var dnsServerConfig = DNSServerConfig{
+	Enabled:              false,
+	Address:              ":5300",
+	NXDomainDelay:        0,
+	CacheRefreshInterval: 5 * time.Second,
+}
+
+func loadDNSServerConfig() (DNSServerConfig, error) {
+	conf := dnsServerConfig
+
+	if v, ok := os.LookupEnv(dnsServerEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return DNSServerConfig{}, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", dnsServerEnabledEnvKey, err)
+		}
+		conf.Enabled = enabled
+	}
+	if v, ok := os.LookupEnv(dnsServerAddressEnvKey); ok {
+		conf.Address = v
+	}
+	if v, ok := os.LookupEnv(dnsServerNXDomainDelayMillisEnvKey); ok {
+		millis, err := strconv.Atoi(v)
+		if err != nil || millis < 0 {
+			return DNSServerConfig{}, fmt.Errorf("environment variable '%s' must be non-negative integer", dnsServerNXDomainDelayMillisEnvKey)
+		}
+		conf.NXDomainDelay = time.Duration(millis) * time.Millisecond
+	}
+	if v, ok := os.LookupEnv(dnsServerCacheRefreshSecondsEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return DNSServerConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", dnsServerCacheRefreshSecondsEnvKey)
+		}
+		conf.CacheRefreshInterval = time.Duration(seconds) * time.Second
+	}
+
+	return conf, nil
+}
+
+// 組み込みDNSサーバが返すユーザのAレコードを、メモリ上に持つプロバイダ
+// 他のサーバで登録されたユーザは次のLoadまで載らないので、見つからなければusersを引く
+type EmbeddedDNSProvider struct {
+	db sqlx.QueryerContext
+
+	mu            sync.RWMutex
+	addressByName map[string]string
+	// usersにもなかった名前 -> 期限
+	missingUntil map[string]time.Time
+	// Load中に追加・削除された名前 -> アドレス (削除なら空文字列)
+	// 読み込んだ結果に上書きして、取りこぼさないようにする
+	changes map[string]string
+
+	loadMu sync.Mutex
+}
+
+func newEmbeddedDNSProvider(db sqlx.QueryerContext) *EmbeddedDNSProvider {
+	return &EmbeddedDNSProvider{
+		db:            db,
+		addressByName: map[string]string{},
+		missingUntil:  map[string]time.Time{},
+	}
+}
+
+func (p *EmbeddedDNSProvider) AddRecord(ctx context.Context, name string, address string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(strings.ToLower(name), address)
+	return nil
+}
+
+func (p *EmbeddedDNSProvider) DeleteRecord(ctx context.Context, name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(strings.ToLower(name), "")
+	return nil
+}
+
+// p.muをロックして呼ぶ
+func (p *EmbeddedDNSProvider) set(name string, address string) {
+	if address == "" {
+		delete(p.addressByName, name)
+	} else {
+		p.addressByName[name] = address
+		delete(p.missingUntil, name)
+	}
+	if p.changes != nil {
+		p.changes[name] = address
+	}
+}
+
+func (p *EmbeddedDNSProvider) ListRecords(ctx context.Context) (map[string]string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	addressByName := make(map[string]string, len(p.addressByName))
+	for name, address := range p.addressByName {
+		addressByName[name] = address
+	}
+	return addressByName, nil
+}
+
+// キャッシュになければusersを引き、なかった名前はdnsServerNegativeCacheTTLの間覚えておく
+func (p *EmbeddedDNSProvider) Lookup(ctx context.Context, name string) (string, bool, error) {
+	p.mu.RLock()
+	address, ok := p.addressByName[name]
+	missingUntil, missing := p.missingUntil[name]
+	p.mu.RUnlock()
+	if ok {
+		return address, true, nil
+	}
+	if p.db == nil || !isDNSLabel(name) || (missing && time.Now().Before(missingUntil)) {
+		return "", false, nil
+	}
+
+	var count int
+	if err := sqlx.GetContext(ctx, p.db, &count, "SELECT COUNT(*) FROM users WHERE LOWER(name) = ? AND deleted_at IS NULL", name); err != nil {
+		return "", false, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// 問い合わせ中に追加・削除されていれば、そちらに従う
+	if address, ok := p.addressByName[name]; ok {
+		return address, true, nil
+	}
+	if count == 0 {
+		p.missingUntil[name] = time.Now().Add(dnsServerNegativeCacheTTL)
+		return "", false, nil
+	}
+	p.addressByName[name] = powerDNSSubdomainAddress
+	return powerDNSSubdomainAddress, true, nil
+}
+
+// usersからレコードを作り直す
+// 読み込み中に追加・削除されたレコードは、読み込んだ結果に上書きする
+func (p *EmbeddedDNSProvider) Load(ctx context.Context, db sqlx.QueryerContext) error {
+	p.loadMu.Lock()
+	defer p.loadMu.Unlock()
+
+	p.mu.Lock()
+	p.changes = map[string]string{}
+	p.mu.Unlock()
+
+	var names []string
+	if err := sqlx.SelectContext(ctx, db, &names, "SELECT name FROM users WHERE deleted_at IS NULL"); err != nil {
+		p.mu.Lock()
+		p.changes = nil
+		p.mu.Unlock()
+		return fmt.Errorf("failed to get users: %w", err)
+	}
+
+	addressByName := make(map[string]string, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if !isDNSLabel(name) {
+			continue
+		}
+		addressByName[name] = powerDNSSubdomainAddress
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, address := range p.changes {
+		if address == "" {
+			delete(addressByName, name)
+		} else {
+			addressByName[name] = address
+		}
+	}
+	p.addressByName = addressByName
+	p.missingUntil = map[string]time.Time{}
+	p.changes = nil
+	return nil
+}
+
+// u.isucon.devの権威サーバ
+type DNSServer struct {
+	conf     DNSServerConfig
+	provider *EmbeddedDNSProvider
+	soa      dnsmessage.Resource
+	// ゾーンからの相対名 -> 静的なレコード
+	static map[string][]dnsmessage.Resource
+}
+
+func newDNSServer(conf DNSServerConfig, provider *EmbeddedDNSProvider, zone *StaticZone) (*DNSServer, error) {
+	s := &DNSServer{
+		conf:     conf,
+		provider: provider,
+		static:   map[string][]dnsmessage.Resource{},
+	}
+
+	for _, record := range zone.Records {
+		resource, err := newZoneResource(record)
+		if err != nil {
+			return nil, err
+		}
+		if resource.Header.Type == dnsmessage.TypeSOA {
+			s.soa = resource
+		}
+		s.static[record.Name] = append(s.static[record.Name], resource)
+	}
+	if s.soa.Body == nil {
+		return nil, fmt.Errorf("zone %s has no SOA record", powerDNSZone)
+	}
+
+	return s, nil
+}
+
+// ゾーンファイル中の相対名を完全修飾する
+func zoneFQDN(name string) (dnsmessage.Name, error) {
+	switch {
+	case name == "@":
+		return dnsmessage.NewName(powerDNSZone + ".")
+	case strings.HasSuffix(name, "."):
+		return dnsmessage.NewName(name)
+	default:
+		return dnsmessage.NewName(name + "." + powerDNSZone + ".")
+	}
+}
+
+func newZoneResource(record ZoneRecord) (dnsmessage.Resource, error) {
+	name, err := zoneFQDN(record.Name)
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+	header := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: record.TTL}
+
+	fields := strings.Fields(record.Value)
+	switch record.Type {
+	case "A":
+		addr, err := netip.ParseAddr(record.Value)
+		if err != nil || !addr.Is4() {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid A record for %s: %s", record.Name, record.Value)
+		}
+		header.Type = dnsmessage.TypeA
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}}, nil
+	case "NS":
+		ns, err := zoneFQDN(record.Value)
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		header.Type = dnsmessage.TypeNS
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.NSResource{NS: ns}}, nil
+	case "SOA":
+		if len(fields) != 7 {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid SOA record for %s: %s", record.Name, record.Value)
+		}
+		ns, err := zoneFQDN(fields[0])
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		mbox, err := zoneFQDN(fields[1])
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+		var values [5]uint32
+		for i := range values {
+			v, err := strconv.ParseUint(fields[i+2], 10, 32)
+			if err != nil {
+				return dnsmessage.Resource{}, fmt.Errorf("invalid SOA record for %s: %s", record.Name, record.Value)
+			}
+			values[i] = uint32(v)
+		}
+		header.Type = dnsmessage.TypeSOA
+		return dnsmessage.Resource{Header: header, Body: &dnsmessage.SOAResource{
+			NS: ns, MBox: mbox, Serial: values[0], Refresh: values[1], Retry: values[2], Expire: values[3], MinTTL: values[4],
+		}}, nil
+	default:
+		return dnsmessage.Resource{}, fmt.Errorf("unsupported record type %s for %s", record.Type, record.Name)
+	}
+}
+
+// 問い合わせに対する応答を組み立てる
+// 応答しない (dnsdist.confのDropActionと同じ) 場合はnilを返す
+func (s *DNSServer) answer(req []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	reqHeader, err := p.Start(req)
+	if err != nil || reqHeader.Response {
+		return nil, false
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, false
+	}
+
+	header := dnsmessage.Header{
+		ID:                 reqHeader.ID,
+		Response:           true,
+		OpCode:             reqHeader.OpCode,
+		Authoritative:      true,
+		RecursionDesired:   reqHeader.RecursionDesired,
+		RecursionAvailable: false,
+		RCode:              dnsmessage.RCodeSuccess,
+	}
+	var (
+		answers     []dnsmessage.Resource
+		authorities []dnsmessage.Resource
+		nxdomain    bool
+	)
+
+	qname := strings.ToLower(question.Name.String())
+	suffix := "." + powerDNSZone + "."
+	switch {
+	case reqHeader.OpCode != 0 || question.Class != dnsmessage.ClassINET:
+		header.RCode = dnsmessage.RCodeNotImplemented
+		header.Authoritative = false
+	case qname != powerDNSZone+"." && !strings.HasSuffix(qname, suffix):
+		header.RCode = dnsmessage.RCodeRefused
+		header.Authoritative = false
+	default:
+		name := "@"
+		if qname != powerDNSZone+"." {
+			name = strings.TrimSuffix(qname, suffix)
+		}
+		// dnsdistを通さない場合も同じ問い合わせを捨てる
+		// (ハイフンを含むなど、正規表現に一致しない名前はNXDOMAINになる)
+		if dnsServerDropRegexp.MatchString(strings.TrimSuffix(qname, ".")) {
+			return nil, false
+		}
+
+		resources, found, err := s.lookup(name, question.Name)
+		if err != nil {
+			header.RCode = dnsmessage.RCodeServerFailure
+			header.Authoritative = false
+			break
+		}
+		if !found {
+			header.RCode = dnsmessage.RCodeNameError
+			nxdomain = true
+		}
+		for _, resource := range resources {
+			if resource.Header.Type == question.Type || question.Type == dnsmessage.TypeALL {
+				answers = append(answers, resource)
+			}
+		}
+		if len(answers) == 0 {
+			// NXDOMAIN・NODATAにはネガティブキャッシュのためSOAを付ける
+			authorities = append(authorities, s.soa)
+		}
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, dnsServerMaxUDPMessageSize), header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := b.Question(question); err != nil {
+		return nil, false
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, false
+	}
+	for _, resource := range answers {
+		if err := addResource(&b, resource); err != nil {
+			return nil, false
+		}
+	}
+	if err := b.StartAuthorities(); err != nil {
+		return nil, false
+	}
+	for _, resource := range authorities {
+		if err := addResource(&b, resource); err != nil {
+			return nil, false
+		}
+	}
+	res, err := b.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return res, nxdomain
+}
+
+// ゾーンからの相対名に対するレコード
+// 静的なレコードを優先し、なければユーザのAレコードを返す
+func (s *DNSServer) lookup(name string, qname dnsmessage.Name) ([]dnsmessage.Resource, bool, error) {
+	if resources, ok := s.static[name]; ok {
+		rs := make([]dnsmessage.Resource, len(resources))
+		for i, resource := range resources {
+			// 問い合わせの大文字・小文字に合わせる
+			resource.Header.Name = qname
+			rs[i] = resource
+		}
+		return rs, true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsServerLookupTimeout)
+	defer cancel()
+	address, ok, err := s.provider.Lookup(ctx, name)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil || !addr.Is4() {
+		return nil, true, nil
+	}
+	return []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: dnsServerUserRecordTTL},
+		Body:   &dnsmessage.AResource{A: addr.As4()},
+	}}, true, nil
+}
+
+func addResource(b *dnsmessage.Builder, resource dnsmessage.Resource) error {
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		return b.AResource(resource.Header, *body)
+	case *dnsmessage.NSResource:
+		return b.NSResource(resource.Header, *body)
+	case *dnsmessage.SOAResource:
+		return b.SOAResource(resource.Header, *body)
+	default:
+		return fmt.Errorf("unsupported resource %T", resource.Body)
+	}
+}
+
+func (s *DNSServer) serveUDP(conn net.PacketConn, logger echo.Logger) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Errorf("failed to read dns query: %v", err)
+			continue
+		}
+		req := make([]byte, n)
+		copy(req, buf[:n])
+
+		go func() {
+			res, nxdomain := s.answer(req)
+			if res == nil {
+				return
+			}
+			if nxdomain {
+				time.Sleep(s.conf.NXDomainDelay)
+			}
+			if _, err := conn.WriteTo(res, addr); err != nil {
+				logger.Errorf("failed to write dns response: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) serveTCP(ln net.Listener, logger echo.Logger) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Errorf("failed to accept dns connection: %v", err)
+			continue
+		}
+		go s.handleTCP(conn)
+	}
+}
+
+// TCPでは2バイトの長さに続けてメッセージを送り合う
+func (s *DNSServer) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		if err := conn.SetDeadline(time.Now().Add(dnsServerTCPTimeout)); err != nil {
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+
+		res, nxdomain := s.answer(req)
+		if res == nil {
+			return
+		}
+		if nxdomain {
+			time.Sleep(s.conf.NXDomainDelay)
+		}
+		msg := make([]byte, 2+len(res))
+		binary.BigEndian.PutUint16(msg, uint16(len(res)))
+		copy(msg[2:], res)
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// 組み込みDNSサーバを起動し、CacheRefreshIntervalごとにキャッシュを作り直す
+func startDNSServer(logger echo.Logger, s *DNSServer) error {
+	udpConn, err := net.ListenPacket("udp", s.conf.Address)
+	if err != nil {
+		return err
+	}
+	tcpListener, err := net.Listen("tcp", s.conf.Address)
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
+	go s.serveUDP(udpConn, logger)
+	go s.serveTCP(tcpListener, logger)
+
+	go func() {
+		ticker := time.NewTicker(s.conf.CacheRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.provider.Load(context.Background(), dbConn); err != nil {
+				logger.Errorf("failed to refresh dns records: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestDNSServer(t *testing.T, conf DNSServerConfig) *DNSServer {
+	t.Helper()
+	zone := &StaticZone{Records: []ZoneRecord{
+		{Name: "@", TTL: 3600, Type: "SOA", Value: "ns1 hostmaster.u.isucon.dev. 0 10800 3600 604800 3600"},
+		{Name: "@", Type: "NS", Value: "ns1.u.isucon.dev."},
+		{Name: "pipe", Type: "A", Value: "192.0.2.1"},
+	}}
+	provider := newEmbeddedDNSProvider(nil)
+	if err := provider.AddRecord(context.Background(), "alice", "192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newDNSServer(conf, provider, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestDNSQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	req, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func parseTestDNSResponse(t *testing.T, res []byte) dnsmessage.Message {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(res); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 1234 || !msg.Header.Response {
+		t.Fatalf("unexpected header: %+v", msg.Header)
+	}
+	return msg
+}
+
+func TestDNSServerAnswer(t *testing.T) {
+	s := newTestDNSServer(t, dnsServerConfig)
+
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    dnsmessage.Type
+		rcode    dnsmessage.RCode
+		nxdomain bool
+		// 空ならAレコードを返さない
+		address string
+	}{
+		{name: "static record", qname: "pipe.u.isucon.dev.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeSuccess, address: "192.0.2.1"},
+		{name: "user record", qname: "alice.u.isucon.dev.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeSuccess, address: "192.0.2.2"},
+		{name: "user record in upper case", qname: "ALICE.u.isucon.dev.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeSuccess, address: "192.0.2.2"},
+		{name: "no data", qname: "alice.u.isucon.dev.", qtype: dnsmessage.TypeAAAA, rcode: dnsmessage.RCodeSuccess},
+		{name: "unknown user", qname: "bob.u.isucon.dev.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError, nxdomain: true},
+		{name: "name not matching the drop rule", qname: "a.b-c.u.isucon.dev.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError, nxdomain: true},
+		{name: "out of zone", qname: "example.com.", qtype: dnsmessage.TypeA, rcode: dnsmessage.RCodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, nxdomain := s.answer(newTestDNSQuery(t, tt.qname, tt.qtype))
+			if res == nil {
+				t.Fatal("query was dropped")
+			}
+			if nxdomain != tt.nxdomain {
+				t.Errorf("nxdomain = %v, want %v", nxdomain, tt.nxdomain)
+			}
+			msg := parseTestDNSResponse(t, res)
+			if msg.Header.RCode != tt.rcode {
+				t.Errorf("rcode = %v, want %v", msg.Header.RCode, tt.rcode)
+			}
+
+			if tt.address == "" {
+				if len(msg.Answers) != 0 {
+					t.Errorf("got %d answers, want none", len(msg.Answers))
+				}
+				// 否定応答にはSOAを付ける
+				if tt.rcode != dnsmessage.RCodeRefused && (len(msg.Authorities) != 1 || msg.Authorities[0].Header.Type != dnsmessage.TypeSOA) {
+					t.Errorf("negative response has authorities %+v, want SOA", msg.Authorities)
+				}
+				return
+			}
+			if len(msg.Answers) != 1 {
+				t.Fatalf("got %d answers, want 1", len(msg.Answers))
+			}
+			a, ok := msg.Answers[0].Body.(*dnsmessage.AResource)
+			if !ok {
+				t.Fatalf("answer is %T, want A record", msg.Answers[0].Body)
+			}
+			if got := net.IP(a.A[:]).String(); got != tt.address {
+				t.Errorf("address = %s, want %s", got, tt.address)
+			}
+			if msg.Answers[0].Header.Name.String() != tt.qname {
+				t.Errorf("answer name = %s, want %s", msg.Answers[0].Header.Name, tt.qname)
+			}
+		})
+	}
+}
+
+func TestDNSServerAnswerDropsDeepNames(t *testing.T) {
+	s := newTestDNSServer(t, dnsServerConfig)
+	for _, qname := range []string{"a.alice.u.isucon.dev.", "a.pipe.u.isucon.dev.", "x.y.z.u.isucon.dev."} {
+		if res, _ := s.answer(newTestDNSQuery(t, qname, dnsmessage.TypeA)); res != nil {
+			t.Errorf("query for %s was answered", qname)
+		}
+	}
+}
+
+func TestDNSServerDelaysNXDomain(t *testing.T) {
+	conf := dnsServerConfig
+	conf.NXDomainDelay = 200 * time.Millisecond
+	s := newTestDNSServer(t, conf)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.serveUDP(conn, echo.New().Logger)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	query := func(qname string) (dnsmessage.Message, time.Duration) {
+		start := time.Now()
+		if _, err := client.Write(newTestDNSQuery(t, qname, dnsmessage.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, dnsServerMaxUDPMessageSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseTestDNSResponse(t, buf[:n]), time.Since(start)
+	}
+
+	if msg, elapsed := query("alice.u.isucon.dev."); msg.Header.RCode != dnsmessage.RCodeSuccess || elapsed >= conf.NXDomainDelay {
+		t.Errorf("existing name: rcode = %v, elapsed = %s", msg.Header.RCode, elapsed)
+	}
+	if msg, elapsed := query("a.b-c.u.isucon.dev."); msg.Header.RCode != dnsmessage.RCodeNameError || elapsed < conf.NXDomainDelay {
+		t.Errorf("nxdomain: rcode = %v, elapsed = %s", msg.Header.RCode, elapsed)
+	}
+}
+
+func newTestEmbeddedDNSProvider(t *testing.T) (*EmbeddedDNSProvider, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return newEmbeddedDNSProvider(sqlx.NewDb(db, "mysql")), mock
+}
+
+func TestEmbeddedDNSProviderLookupFallsBackToUsers(t *testing.T) {
+	p, mock := newTestEmbeddedDNSProvider(t)
+	query := regexp.QuoteMeta("SELECT COUNT(*) FROM users WHERE LOWER(name) = ? AND deleted_at IS NULL")
+
+	// 他のサーバで登録されたユーザ
+	mock.ExpectQuery(query).WithArgs("bob").WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(1))
+	// いないユーザは少しの間usersを引かない
+	mock.ExpectQuery(query).WithArgs("carol").WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(0))
+
+	for i := 0; i < 2; i++ {
+		if _, ok, err := p.Lookup(context.Background(), "bob"); err != nil || !ok {
+			t.Errorf("Lookup(bob) = %v, %v", ok, err)
+		}
+		if _, ok, err := p.Lookup(context.Background(), "carol"); err != nil || ok {
+			t.Errorf("Lookup(carol) = %v, %v", ok, err)
+		}
+	}
+
+	// 追加されれば、すぐに引ける
+	if err := p.AddRecord(context.Background(), "carol", "192.0.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if address, ok, err := p.Lookup(context.Background(), "carol"); err != nil || !ok || address != "192.0.2.3" {
+		t.Errorf("Lookup(carol) after AddRecord = %q, %v, %v", address, ok, err)
+	}
+}
+
+func TestEmbeddedDNSProviderLoadKeepsConcurrentChanges(t *testing.T) {
+	p, mock := newTestEmbeddedDNSProvider(t)
+	if err := p.AddRecord(context.Background(), "dave", "192.0.2.4"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := make(chan struct{})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name FROM users WHERE deleted_at IS NULL")).
+		WillDelayFor(100 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("alice").AddRow("dave"))
+	go func() {
+		defer close(loaded)
+		if err := p.Load(context.Background(), p.db); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// 読み込み中に登録・退会された
+	time.Sleep(20 * time.Millisecond)
+	if err := p.AddRecord(context.Background(), "bob", "192.0.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteRecord(context.Background(), "dave"); err != nil {
+		t.Fatal(err)
+	}
+	<-loaded
+
+	records, err := p.ListRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hasAlice := records["alice"]
+	if len(records) != 2 || !hasAlice || records["bob"] != "192.0.2.3" {
+		t.Errorf("records = %v, want alice and bob", records)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	powerDNSZoneFileEnvKey = "ISUCON13_POWERDNS_ZONE_FILE"
+
+	// ゾーンファイル中のアドレスのプレースホルダ (init_zone.shで置換されるもの)
+	zoneFileAddressPlaceholder = "<ISUCON_SUBDOMAIN_ADDRESS>"
+)
+
+// init_zone.shで読み込まれるゾーンファイル
+var zoneFile = "../pdns/u.isucon.dev.zone"
+
+// ゾーンファイルに静的に書かれたレコード
+type ZoneRecord struct {
+	// ゾーンからの相対名 (小文字、ゾーン自体は@)
+	Name  string
+	TTL   uint32
+	Type  string
+	Value string
+}
+
+// ゾーンファイルに静的に書かれたレコードの一覧
+type StaticZone struct {
+	Records []ZoneRecord
+	names   map[string]bool
+}
+
+var staticZone = &StaticZone{names: map[string]bool{}}
+
+// nameがゾーンファイルに書かれているか
+func (z *StaticZone) Has(name string) bool {
+	return z.names[strings.ToLower(name)]
+}
+
+func loadStaticZone(address string) (*StaticZone, error) {
+	path := zoneFile
+	if v, ok := os.LookupEnv(powerDNSZoneFileEnvKey); ok {
+		path = v
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z := &StaticZone{names: map[string]bool{}}
+	var (
+		owner string
+		// SOAのように括弧で複数行にまたがるレコード
+		pending []string
+		depth   int
+		lineNo  int
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "$") {
+			continue
+		}
+
+		fields := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(line))
+		if depth == 0 {
+			// 行頭が空白なら直前のレコードと同じ名前
+			if line[0] != ' ' && line[0] != '\t' {
+				owner = strings.ToLower(fields[0])
+				fields = fields[1:]
+			}
+			if owner == "" {
+				return nil, fmt.Errorf("%s:%d: record without owner name", path, lineNo)
+			}
+		}
+		for _, field := range fields {
+			switch field {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			default:
+				pending = append(pending, field)
+			}
+		}
+		if depth > 0 {
+			continue
+		}
+
+		record, err := parseZoneRecord(owner, pending, address)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		pending = nil
+		z.Records = append(z.Records, record)
+		z.names[record.Name] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return z, nil
+}
+
+// [TTL] [IN] TYPE VALUE...
+func parseZoneRecord(owner string, fields []string, address string) (ZoneRecord, error) {
+	record := ZoneRecord{Name: owner}
+	if len(fields) > 0 {
+		if ttl, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+			record.TTL = uint32(ttl)
+			fields = fields[1:]
+		}
+	}
+	if len(fields) > 0 && strings.EqualFold(fields[0], "IN") {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return ZoneRecord{}, fmt.Errorf("invalid record for %s", owner)
+	}
+	record.Type = strings.ToUpper(fields[0])
+	record.Value = strings.ReplaceAll(strings.Join(fields[1:], " "), zoneFileAddressPlaceholder, address)
+	return record, nil
+}
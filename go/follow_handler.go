@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type FollowModel struct {
+	ID         int64 `db:"id"`
+	FollowerID int64 `db:"follower_id"`
+	FolloweeID int64 `db:"followee_id"`
+	CreatedAt  int64 `db:"created_at"`
+}
+
+// User.ID -> フォローされている数, User.ID -> フォローしている数
+func bulkGetFollowCounts(ctx context.Context, db sqlx.QueryerContext, userIds []int64) (map[int64]int64, map[int64]int64, error) {
+	followerCountByUserId := make(map[int64]int64)
+	followingCountByUserId := make(map[int64]int64)
+	if len(userIds) == 0 {
+		return followerCountByUserId, followingCountByUserId, nil
+	}
+
+	type followCount struct {
+		UserID int64 `db:"user_id"`
+		Count  int64 `db:"count"`
+	}
+
+	query, args, err := sqlx.In("SELECT followee_id AS user_id, COUNT(*) AS count FROM follows WHERE followee_id IN (?) GROUP BY followee_id", userIds)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to construct IN query for follows: %w", err)
+	}
+	var followerCounts []followCount
+	if err := sqlx.SelectContext(ctx, db, &followerCounts, query, args...); err != nil {
+		return nil, nil, fmt.Errorf("failed to count followers: %w", err)
+	}
+	for _, c := range followerCounts {
+		followerCountByUserId[c.UserID] = c.Count
+	}
+
+	query, args, err = sqlx.In("SELECT follower_id AS user_id, COUNT(*) AS count FROM follows WHERE follower_id IN (?) GROUP BY follower_id", userIds)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to construct IN query for follows: %w", err)
+	}
+	var followingCounts []followCount
+	if err := sqlx.SelectContext(ctx, db, &followingCounts, query, args...); err != nil {
+		return nil, nil, fmt.Errorf("failed to count followings: %w", err)
+	}
+	for _, c := range followingCounts {
+		followingCountByUserId[c.UserID] = c.Count
+	}
+
+	return followerCountByUserId, followingCountByUserId, nil
+}
+
+func getUserModelByName(ctx context.Context, tx *sqlx.Tx, username string) (UserModel, error) {
+	var userModel UserModel
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserModel{}, echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return UserModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	return userModel, nil
+}
+
+// limitは省略可能で、省略時は全件返す
+func parseOptionalLimit(c echo.Context) (int, error) {
+	v := c.QueryParam("limit")
+	if v == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be between 1 and %d", maxPageLimit))
+	}
+	return limit, nil
+}
+
+// ユーザのフォロー
+// POST /api/user/:username/follow
+func followHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followee, err := getUserModelByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+	if followee.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't follow yourself")
+	}
+
+	// 既にフォローしている場合は何もしない
+	if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)", userID, followee.ID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ユーザのフォロー解除
+// DELETE /api/user/:username/follow
+func unfollowHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	followee, err := getUserModelByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userID, followee.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// フォロワー一覧 (新しくフォローした順)
+// GET /api/user/:username/followers
+func getFollowersHandler(c echo.Context) error {
+	return getFollowUsers(c, "SELECT u.* FROM follows f INNER JOIN users u ON u.id = f.follower_id WHERE f.followee_id = ? ORDER BY f.id DESC")
+}
+
+// フォロー中のユーザ一覧 (新しくフォローした順)
+// GET /api/user/:username/following
+func getFollowingHandler(c echo.Context) error {
+	return getFollowUsers(c, "SELECT u.* FROM follows f INNER JOIN users u ON u.id = f.followee_id WHERE f.follower_id = ? ORDER BY f.id DESC")
+}
+
+func getFollowUsers(c echo.Context, query string) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	limit, err := parseOptionalLimit(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel, err := getUserModelByName(ctx, tx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{userModel.ID}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get follows: "+err.Error())
+	}
+
+	userById, err := bulkFillUserResponse(ctx, tx, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to bulkFillUserResponse: "+err.Error())
+	}
+	users := make([]User, len(userModels))
+	for i, userModel := range userModels {
+		users[i] = userById[userModel.ID]
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, users)
+}
+
+// フォロー中のユーザの予約中・配信中の配信一覧 (開始が早い順)
+// コラボレーターとして参加する配信も含める
+// GET /api/feed
+func getFeedHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit, err := parseOptionalLimit(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	query := `SELECT * FROM livestreams
+		WHERE end_at > ? AND (
+			user_id IN (SELECT followee_id FROM follows WHERE follower_id = ?)
+			OR id IN (SELECT lc.livestream_id FROM livestream_collaborators lc INNER JOIN follows f ON f.followee_id = lc.user_id WHERE f.follower_id = ?)
+		)
+		ORDER BY start_at ASC, id ASC`
+	args := []interface{}{time.Now().Unix(), userID, userID}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	livestreams, err := bulkFillLivestreamResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to bulkFillLivestreamResponse: "+err.Error())
+	}
+	if livestreams == nil {
+		livestreams = []Livestream{}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
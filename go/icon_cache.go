@@ -54,6 +54,13 @@ func getIconHashByIds(ctx context.Context, db sqlx.QueryerContext, userIds []int
 	return resHashByUserId, nil
 }
 
+// アイコンやプロフィールの変更後、次の参照でDBから引き直させる
+func invalidateIconCache(userId int64) {
+	iconCacheMutex.Lock()
+	defer iconCacheMutex.Unlock()
+	delete(iconCache, userId)
+}
+
 func getIconHashById(ctx context.Context, db sqlx.QueryerContext, userId int64) (string, error) {
 	hashByUserId, err := getIconHashByIds(ctx, db, []int64{userId})
 	if err != nil {
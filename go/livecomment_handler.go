@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -84,23 +83,28 @@ func getLivecommentsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+	page, err := parsePageQuery(ctx, tx, c, "livecomments", int64(livestreamID))
+	if err != nil {
+		return err
 	}
+	query, args := page.BuildQuery("SELECT * FROM livecomments WHERE livestream_id = ?", livestreamID)
 
 	livecommentModels := []LivecommentModel{}
-	err = tx.SelectContext(ctx, &livecommentModels, query, livestreamID)
+	err = tx.SelectContext(ctx, &livecommentModels, query, args...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return c.JSON(http.StatusOK, []*Livecomment{})
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
+	// 常に新しい順で返す
+	if page.IsAfter() {
+		reverseRows(livecommentModels)
+	}
+	if n := len(livecommentModels); n > 0 {
+		newest, oldest := livecommentModels[0], livecommentModels[n-1]
+		setNextCursorHeader(c, page.NextCursor(n, newest.CreatedAt, newest.ID, oldest.CreatedAt, oldest.ID))
+	}
 
 	livecomments, err := bulkFillLivecommentResponse(ctx, tx, livecommentModels)
 	if err != nil {
@@ -137,8 +141,27 @@ func getNgwords(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// モデレーターには配信に登録された全てのNGワードを返す
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+	query := "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC"
+	args := []interface{}{userID, livestreamID}
+	if canModerate {
+		query = "SELECT * FROM ng_words WHERE livestream_id = ? ORDER BY created_at DESC"
+		args = []interface{}{livestreamID}
+	}
+
 	var ngWords []*NGWord
-	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &ngWords, query, args...); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.JSON(http.StatusOK, []*NGWord{})
 		} else {
@@ -176,25 +199,40 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	livecomment, err := postLivecomment(ctx, c.Logger(), userID, int64(livestreamID), req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, livecomment)
+}
+
+// ライブコメントを投稿し、購読者に配信する
+// HTTP/WebSocketの両方から呼ばれるので、エラーはecho.NewHTTPErrorで返す
+func postLivecomment(ctx context.Context, logger echo.Logger, userID, livestreamID int64, req *PostLivecommentRequest) (Livecomment, error) {
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
 	var livestreamModel LivestreamModel
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			return Livecomment{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
 		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
+	if err := livestreamModel.ensureNotEnded(); err != nil {
+		return Livecomment{}, err
+	}
 
 	// スパム判定
+	// コラボレーターが登録したNGワードも対象にする
 	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE livestream_id = ?", livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
 
 	var hitSpam int
@@ -208,18 +246,18 @@ func postLivecommentHandler(c echo.Context) error {
 		ON texts.text LIKE patterns.pattern;
 		`
 		if err := tx.GetContext(ctx, &hitSpam, query, req.Comment, ngword.Word); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get hitspam: "+err.Error())
+			return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get hitspam: "+err.Error())
 		}
-		c.Logger().Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
+		logger.Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
 		if hitSpam >= 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
+			return Livecomment{}, echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
 		}
 	}
 
 	now := time.Now().Unix()
 	livecommentModel := LivecommentModel{
 		UserID:       userID,
-		LivestreamID: int64(livestreamID),
+		LivestreamID: livestreamID,
 		Comment:      req.Comment,
 		Tip:          req.Tip,
 		CreatedAt:    now,
@@ -227,25 +265,37 @@ func postLivecommentHandler(c echo.Context) error {
 
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecommentModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
 	}
 
 	livecommentID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
 	}
 	livecommentModel.ID = livecommentID
 
+	if err := notifyMentions(ctx, tx, livecommentModel); err != nil {
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to notify mentions: "+err.Error())
+	}
+
 	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+	}
+
+	if livecomment.Tip > 0 {
+		if err := enqueueWebhookEvent(ctx, tx, livestreamModel.UserID, WebhookEventLivecommentTip, livecomment); err != nil {
+			return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return Livecomment{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, livecomment)
+	publishLivecommentEvent(livecomment)
+
+	return livecomment, nil
 }
 
 func reportLivecommentHandler(c echo.Context) error {
@@ -311,10 +361,17 @@ func reportLivecommentHandler(c echo.Context) error {
 	}
 	reportModel.ID = reportID
 
+	if err := notifyLivecommentReported(ctx, tx, livestreamModel, reportModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to notify report: "+err.Error())
+	}
+
 	report, err := fillLivecommentReportResponse(ctx, tx, reportModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
 	}
+	if err := enqueueWebhookEvent(ctx, tx, livestreamModel.UserID, WebhookEventLivecommentReported, report); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+	}
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
@@ -352,12 +409,19 @@ func moderateHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
+	// 配信者自身かコラボレーターによるmoderateなのかを検証
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	if len(ownedLivestreams) == 0 {
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+	if !canModerate {
 		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
 	}
 
@@ -376,7 +440,21 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
 	}
 
+	// 削除を購読者に通知するため、消えるライブコメントのIDを控えておく
+	var deletedLivecommentIDs []int64
 	query := `
+	SELECT DISTINCT livecomments.id FROM livecomments
+	INNER JOIN ng_words ON livecomments.livestream_id = ng_words.livestream_id
+	WHERE
+	livecomments.livestream_id = ? AND
+	livecomments.comment LIKE CONCAT('%', ng_words.word, '%')
+	FOR UPDATE;
+	`
+	if err := tx.SelectContext(ctx, &deletedLivecommentIDs, query, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get old livecomments that hit spams: "+err.Error())
+	}
+
+	query = `
 	DELETE livecomments FROM livecomments
 	INNER JOIN ng_words ON livecomments.livestream_id = ng_words.livestream_id
 	WHERE
@@ -391,6 +469,8 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	publishCommentDeletedEvents(int64(livestreamID), deletedLivecommentIDs)
+
 	return c.JSON(http.StatusCreated, map[string]interface{}{
 		"word_id": wordID,
 	})
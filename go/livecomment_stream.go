@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const livecommentStreamHeartbeat = 15 * time.Second
+
+// ライブコメントのSSE配信API
+// GET /api/livestream/:livestream_id/livecomment/stream
+func streamLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var lastEventID int64
+	if v := c.Request().Header.Get("Last-Event-ID"); v != "" {
+		lastEventID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Last-Event-ID header must be integer")
+		}
+	}
+
+	// 取りこぼしがないように、過去分を読む前に購読しておく
+	ch := livestreamEventHub.Subscribe(int64(livestreamID))
+	defer livestreamEventHub.Unsubscribe(int64(livestreamID), ch)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if count == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+	}
+
+	// Last-Event-ID以降のコメントを再送する
+	backlog := []Livecomment{}
+	if lastEventID > 0 {
+		livecommentModels := []LivecommentModel{}
+		if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND id > ? ORDER BY id ASC", livestreamID, lastEventID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		backlog, err = bulkFillLivecommentResponse(ctx, tx, livecommentModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to bulkFillLivecommentResponse: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	// nginxでバッファリングされないようにする
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	// hubのイベントはコミット順に届き、IDの順とは限らないので、再送したIDだけを覚えておく
+	sentIDs := make(map[int64]struct{}, len(backlog))
+	for _, livecomment := range backlog {
+		if err := writeLivecommentEvent(res, livecomment); err != nil {
+			return nil
+		}
+		sentIDs[livecomment.ID] = struct{}{}
+	}
+
+	heartbeat := time.NewTicker(livecommentStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case event, ok := <-ch:
+			if !ok {
+				// hubから切断された
+				return nil
+			}
+			if event.Type != LivestreamEventLivecomment {
+				continue
+			}
+			// 再送分と重複したものは捨てる
+			if _, ok := sentIDs[event.Livecomment.ID]; ok {
+				delete(sentIDs, event.Livecomment.ID)
+				continue
+			}
+			if err := writeLivecommentEvent(res, *event.Livecomment); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+func writeLivecommentEvent(res *echo.Response, livecomment Livecomment) error {
+	data, err := json.Marshal(livecomment)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(res, "id: %d\nevent: livecomment\ndata: %s\n\n", livecomment.ID, data); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
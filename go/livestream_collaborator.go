@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 1配信あたりのコラボレーターの上限
+const maxLivestreamCollaborators = 10
+
+type LivestreamCollaboratorModel struct {
+	ID           int64 `db:"id"`
+	LivestreamID int64 `db:"livestream_id"`
+	UserID       int64 `db:"user_id"`
+}
+
+// 予約時に指定されたコラボレーターを検証し、重複を除いて返す
+func validateCollaborators(ctx context.Context, db sqlx.QueryerContext, ownerID int64, collaboratorIDs []int64) ([]int64, error) {
+	seen := make(map[int64]struct{}, len(collaboratorIDs))
+	ids := make([]int64, 0, len(collaboratorIDs))
+	for _, id := range collaboratorIDs {
+		if id == ownerID {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "the owner can't be a collaborator")
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return ids, nil
+	}
+	if len(ids) > maxLivestreamCollaborators {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("a livestream can have at most %d collaborators", maxLivestreamCollaborators))
+	}
+
+	query, args, err := sqlx.In("SELECT COUNT(*) FROM users WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for users: "+err.Error())
+	}
+	var count int
+	if err := sqlx.GetContext(ctx, db, &count, query, args...); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	if count != len(ids) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "some collaborators are not found")
+	}
+
+	return ids, nil
+}
+
+func insertCollaborators(ctx context.Context, tx *sqlx.Tx, livestreamID int64, collaboratorIDs []int64) error {
+	for _, userID := range collaboratorIDs {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_collaborators (livestream_id, user_id) VALUES (:livestream_id, :user_id)", &LivestreamCollaboratorModel{
+			LivestreamID: livestreamID,
+			UserID:       userID,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Livestream.ID -> []コラボレーターのUser.ID
+func bulkGetCollaboratorIDsByLivestream(ctx context.Context, db sqlx.QueryerContext, livestreamIds []int64) (map[int64][]int64, error) {
+	collaboratorIDsByLivestreamId := make(map[int64][]int64)
+	if len(livestreamIds) == 0 {
+		return collaboratorIDsByLivestreamId, nil
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM livestream_collaborators WHERE livestream_id IN (?) ORDER BY id", livestreamIds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct IN query for livestream_collaborators: %w", err)
+	}
+	var collaboratorModels []*LivestreamCollaboratorModel
+	if err := sqlx.SelectContext(ctx, db, &collaboratorModels, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to query livestream_collaborators: %w", err)
+	}
+	for _, collaboratorModel := range collaboratorModels {
+		collaboratorIDsByLivestreamId[collaboratorModel.LivestreamID] = append(collaboratorIDsByLivestreamId[collaboratorModel.LivestreamID], collaboratorModel.UserID)
+	}
+	return collaboratorIDsByLivestreamId, nil
+}
+
+// 配信者本人とコラボレーターはモデレーションできる
+func canModerateLivestream(ctx context.Context, db sqlx.QueryerContext, livestreamModel LivestreamModel, userID int64) (bool, error) {
+	if livestreamModel.UserID == userID {
+		return true, nil
+	}
+	var count int
+	if err := sqlx.GetContext(ctx, db, &count, "SELECT COUNT(*) FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ?", livestreamModel.ID, userID); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
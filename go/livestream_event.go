@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	LivestreamEventLivecomment    = "livecomment"
+	LivestreamEventReaction       = "reaction"
+	LivestreamEventViewerEnter    = "viewer_enter"
+	LivestreamEventViewerExit     = "viewer_exit"
+	LivestreamEventCommentDeleted = "comment_deleted"
+
+	// 購読者ごとのバッファ。溢れた購読者は切断し、再接続してもらう
+	livestreamEventBufferSize = 64
+)
+
+// 配信ごとにSSE/WebSocketへ流すイベント
+type LivestreamEvent struct {
+	Type          string       `json:"type"`
+	LivestreamID  int64        `json:"livestream_id"`
+	Livecomment   *Livecomment `json:"livecomment,omitempty"`
+	Reaction      *Reaction    `json:"reaction,omitempty"`
+	LivecommentID int64        `json:"livecomment_id,omitempty"`
+	UserID        int64        `json:"user_id,omitempty"`
+	ViewersCount  *int64       `json:"viewers_count,omitempty"`
+}
+
+// 配信ごとのイベントのfan-out hub (プロセス内)
+type LivestreamEventHub struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[chan LivestreamEvent]struct{}
+}
+
+var livestreamEventHub = &LivestreamEventHub{
+	subscribers: make(map[int64]map[chan LivestreamEvent]struct{}),
+}
+
+func (h *LivestreamEventHub) Subscribe(livestreamID int64) chan LivestreamEvent {
+	ch := make(chan LivestreamEvent, livestreamEventBufferSize)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[livestreamID]; !ok {
+		h.subscribers[livestreamID] = make(map[chan LivestreamEvent]struct{})
+	}
+	h.subscribers[livestreamID][ch] = struct{}{}
+	return ch
+}
+
+func (h *LivestreamEventHub) Unsubscribe(livestreamID int64, ch chan LivestreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(livestreamID, ch)
+}
+
+func (h *LivestreamEventHub) Publish(event LivestreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[event.LivestreamID] {
+		select {
+		case ch <- event:
+		default:
+			// 詰まっている購読者は切断する
+			h.removeLocked(event.LivestreamID, ch)
+		}
+	}
+}
+
+func (h *LivestreamEventHub) removeLocked(livestreamID int64, ch chan LivestreamEvent) {
+	subs, ok := h.subscribers[livestreamID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(h.subscribers, livestreamID)
+	}
+}
+
+func publishLivecommentEvent(livecomment Livecomment) {
+	livestreamEventHub.Publish(LivestreamEvent{
+		Type:         LivestreamEventLivecomment,
+		LivestreamID: livecomment.Livestream.ID,
+		Livecomment:  &livecomment,
+	})
+}
+
+func publishReactionEvent(reaction Reaction) {
+	livestreamEventHub.Publish(LivestreamEvent{
+		Type:         LivestreamEventReaction,
+		LivestreamID: reaction.Livestream.ID,
+		Reaction:     &reaction,
+	})
+}
+
+func publishCommentDeletedEvents(livestreamID int64, livecommentIDs []int64) {
+	for _, livecommentID := range livecommentIDs {
+		livestreamEventHub.Publish(LivestreamEvent{
+			Type:          LivestreamEventCommentDeleted,
+			LivestreamID:  livestreamID,
+			LivecommentID: livecommentID,
+		})
+	}
+}
+
+// 視聴者の入退室を現在の視聴者数とともに通知する
+func publishViewerEvent(ctx context.Context, eventType string, userID, livestreamID int64) error {
+	var viewersCount int64
+	if err := dbConn.GetContext(ctx, &viewersCount, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID); err != nil {
+		return err
+	}
+	livestreamEventHub.Publish(LivestreamEvent{
+		Type:         eventType,
+		LivestreamID: livestreamID,
+		UserID:       userID,
+		ViewersCount: &viewersCount,
+	})
+	return nil
+}
@@ -23,6 +23,24 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// コラボレーターのUser.ID
+	Collaborators []int64 `json:"collaborators"`
+	// 指定された場合は繰り返し予約する
+	Recurrence *RecurrenceRule `json:"recurrence,omitempty"`
+}
+
+// nilのフィールドは変更しない
+type UpdateLivestreamRequest struct {
+	Title        *string `json:"title"`
+	Description  *string `json:"description"`
+	PlaylistUrl  *string `json:"playlist_url"`
+	ThumbnailUrl *string `json:"thumbnail_url"`
+	StartAt      *int64  `json:"start_at"`
+	EndAt        *int64  `json:"end_at"`
+}
+
+type PutLivestreamTagsRequest struct {
+	Tags []int64 `json:"tags"`
 }
 
 type LivestreamViewerModel struct {
@@ -42,16 +60,58 @@ type LivestreamModel struct {
 	EndAt        int64  `db:"end_at" json:"end_at"`
 }
 
+const (
+	LivestreamStatusScheduled = "scheduled"
+	LivestreamStatusLive      = "live"
+	LivestreamStatusEnded     = "ended"
+)
+
 type Livestream struct {
-	ID           int64  `json:"id"`
-	Owner        User   `json:"owner"`
-	Title        string `json:"title"`
-	Description  string `json:"description"`
-	PlaylistUrl  string `json:"playlist_url"`
-	ThumbnailUrl string `json:"thumbnail_url"`
-	Tags         []Tag  `json:"tags"`
-	StartAt      int64  `json:"start_at"`
-	EndAt        int64  `json:"end_at"`
+	ID            int64  `json:"id"`
+	Owner         User   `json:"owner"`
+	Title         string `json:"title"`
+	Description   string `json:"description"`
+	PlaylistUrl   string `json:"playlist_url"`
+	ThumbnailUrl  string `json:"thumbnail_url"`
+	Tags          []Tag  `json:"tags"`
+	Collaborators []User `json:"collaborators"`
+	StartAt       int64  `json:"start_at"`
+	EndAt         int64  `json:"end_at"`
+	Status        string `json:"status"`
+}
+
+// 配信の状態を時刻から求める
+func (l LivestreamModel) Status(now int64) string {
+	switch {
+	case now < l.StartAt:
+		return LivestreamStatusScheduled
+	case now < l.EndAt:
+		return LivestreamStatusLive
+	default:
+		return LivestreamStatusEnded
+	}
+}
+
+// 終了した配信へのコメント・リアクション・入室は受け付けない
+func (l LivestreamModel) ensureNotEnded() error {
+	if l.Status(time.Now().Unix()) == LivestreamStatusEnded {
+		return echo.NewHTTPError(http.StatusBadRequest, "the livestream has already ended")
+	}
+	return nil
+}
+
+// status クエリパラメータに対応するlivestreamsの絞り込み条件
+func livestreamStatusCondition(status string, now int64) (string, []interface{}, error) {
+	switch status {
+	case LivestreamStatusScheduled:
+		return "start_at > ?", []interface{}{now}, nil
+	case LivestreamStatusLive:
+		return "start_at <= ? AND end_at > ?", []interface{}{now, now}, nil
+	case LivestreamStatusEnded:
+		return "end_at <= ?", []interface{}{now}, nil
+	default:
+		return "", nil, fmt.Errorf("status must be one of %s, %s and %s", LivestreamStatusScheduled, LivestreamStatusLive, LivestreamStatusEnded)
+	}
 }
 
 type LivestreamTagModel struct {
@@ -86,79 +146,217 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	collaboratorIDs, err := validateCollaborators(ctx, dbConn, userID, req.Collaborators)
+	if err != nil {
+		return err
+	}
+	req.Collaborators = collaboratorIDs
+
+	tagIDs, err := validateTagIDs(req.Tags)
+	if err != nil {
+		return err
+	}
+	req.Tags = tagIDs
+
+	if req.Recurrence != nil {
+		return reserveRecurringLivestreamsHandler(c, userID, req)
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
-	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
-	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	if err := validateReservationTerm(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	if err := lockTags(ctx, tx, req.Tags); err != nil {
+		return err
 	}
 
 	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+	if _, err := lockReservationSlots(ctx, tx, ReservationRange{StartAt: req.StartAt, EndAt: req.EndAt}); err != nil {
 		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+		return err
 	}
-	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
-		}
+
+	livestreamModel, err := reserveLivestream(ctx, tx, userID, req, ReservationRange{StartAt: req.StartAt, EndAt: req.EndAt})
+	if err != nil {
+		return err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := enqueueWebhookEvent(ctx, tx, userID, WebhookEventReservationCreated, livestream); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// 予約枠を確保して配信を作成する
+// 呼び出し前にlockReservationSlotsで予約枠をロックしておくこと
+func reserveLivestream(ctx context.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest, r ReservationRange) (*LivestreamModel, error) {
+	if err := takeReservationSlots(ctx, tx, r.StartAt, r.EndAt); err != nil {
+		return nil, err
 	}
 
 	var (
 		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
+			UserID:       userID,
 			Title:        req.Title,
 			Description:  req.Description,
 			PlaylistUrl:  req.PlaylistUrl,
 			ThumbnailUrl: req.ThumbnailUrl,
-			StartAt:      req.StartAt,
-			EndAt:        req.EndAt,
+			StartAt:      r.StartAt,
+			EndAt:        r.EndAt,
 		}
 	)
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
-	}
-
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
 
 	livestreamID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
 	}
 	livestreamModel.ID = livestreamID
 
 	// タグ追加
-	for _, tagID := range req.Tags {
-		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
-			LivestreamID: livestreamID,
-			TagID:        tagID,
-		}); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+	if err := insertLivestreamTags(ctx, tx, livestreamID, req.Tags); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+	}
+
+	if err := insertCollaborators(ctx, tx, livestreamID, req.Collaborators); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream collaborators: "+err.Error())
+	}
+
+	return livestreamModel, nil
+}
+
+// 配信予約のキャンセル
+// DELETE /api/livestream/:livestream_id
+func cancelLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getReservedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := lockReservationSlots(ctx, tx, ReservationRange{StartAt: livestreamModel.StartAt, EndAt: livestreamModel.EndAt}); err != nil {
+		return err
+	}
+	if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return err
+	}
+
+	if err := deleteLivestream(ctx, tx, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream: "+err.Error())
+	}
+
+	if err := enqueueWebhookEvent(ctx, tx, userID, WebhookEventReservationCanceled, map[string]int64{"livestream_id": livestreamModel.ID}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 配信のタグの付け替え
+// PUT /api/livestream/:livestream_id/tags
+func putLivestreamTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *PutLivestreamTagsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	tagIDs, err := validateTagIDs(req.Tags)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
 		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't change other streamer's livestream")
 	}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	if err := lockTags(ctx, tx, tagIDs); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+	}
+	if err := insertLivestreamTags(ctx, tx, livestreamModel.ID, tagIDs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
@@ -167,12 +365,34 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, livestream)
+	return c.JSON(http.StatusOK, livestream)
 }
 
-func searchLivestreamsHandler(c echo.Context) error {
+// 配信予約の変更
+// PATCH /api/livestream/:livestream_id
+func updateLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -180,53 +400,145 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		var tagIDList []int
-		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-		}
+	livestreamModel, err := getReservedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
 
-		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?)", tagIDList)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for livestream_tags: "+err.Error())
+	var (
+		oldStartAt = livestreamModel.StartAt
+		oldEndAt   = livestreamModel.EndAt
+	)
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if req.PlaylistUrl != nil {
+		livestreamModel.PlaylistUrl = *req.PlaylistUrl
+	}
+	if req.ThumbnailUrl != nil {
+		livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+	}
+	if req.StartAt != nil {
+		livestreamModel.StartAt = *req.StartAt
+	}
+	if req.EndAt != nil {
+		livestreamModel.EndAt = *req.EndAt
+	}
+
+	// 予約区間が変わる場合は、旧区間の枠を返却してから新区間の枠を確保する
+	if livestreamModel.StartAt != oldStartAt || livestreamModel.EndAt != oldEndAt {
+		if livestreamModel.StartAt <= time.Now().Unix() {
+			return echo.NewHTTPError(http.StatusBadRequest, "cannot move a livestream to the past")
 		}
-		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
+		if err := validateReservationTerm(livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return err
 		}
+		if _, err := lockReservationSlots(ctx, tx,
+			ReservationRange{StartAt: oldStartAt, EndAt: oldEndAt},
+			ReservationRange{StartAt: livestreamModel.StartAt, EndAt: livestreamModel.EndAt},
+		); err != nil {
+			return err
+		}
+		if err := releaseReservationSlots(ctx, tx, oldStartAt, oldEndAt); err != nil {
+			return err
+		}
+		if err := takeReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return err
+		}
+	}
 
-		if len(keyTaggedLivestreams) > 0 {
-			livestreamIds := make([]int64, len(keyTaggedLivestreams))
-			for i, keyTaggedLivestream := range keyTaggedLivestreams {
-				livestreamIds[i] = keyTaggedLivestream.LivestreamID
-			}
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url, start_at = :start_at, end_at = :end_at WHERE id = :id", livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
 
-			query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?) ORDER BY id DESC", livestreamIds)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for livestreams: "+err.Error())
-			}
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
 
-			if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreamModels: "+err.Error())
-			}
-		}
-	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+	if err := enqueueWebhookEvent(ctx, tx, userID, WebhookEventReservationUpdated, livestream); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 予約変更のため、自分が所有する開始前の配信をロックして取得する
+func getReservedLivestreamForUpdate(ctx context.Context, tx *sqlx.Tx, livestreamID, userID int64) (LivestreamModel, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
 		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusForbidden, "can't change other streamer's livestream")
+	}
+	if livestreamModel.StartAt <= time.Now().Unix() {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusBadRequest, "the livestream has already started")
+	}
+	return livestreamModel, nil
+}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+// 配信と、それに紐づくデータをすべて削除する
+func deleteLivestream(ctx context.Context, tx *sqlx.Tx, livestreamID int64) error {
+	queries := []string{
+		"DELETE FROM livecomment_reports WHERE livestream_id = ?",
+		"DELETE FROM ng_words WHERE livestream_id = ?",
+		"DELETE FROM reactions WHERE livestream_id = ?",
+		"DELETE FROM livecomments WHERE livestream_id = ?",
+		"DELETE FROM livestream_viewers_history WHERE livestream_id = ?",
+		"DELETE FROM livestream_tags WHERE livestream_id = ?",
+		"DELETE FROM livestream_collaborators WHERE livestream_id = ?",
+		"DELETE FROM notifications WHERE livestream_id = ?",
+		"DELETE FROM livestreams WHERE id = ?",
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, livestreamID); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func searchLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	q, err := parseLivestreamSearchQuery(c)
+	if err != nil {
+		return err
+	}
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	countQuery, countArgs, err := q.CountQuery()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct count query for livestreams: "+err.Error())
+	}
+	var totalCount int64
+	if err := tx.GetContext(ctx, &totalCount, countQuery, countArgs...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestreams: "+err.Error())
+	}
+
+	query, args, err := q.SelectQuery()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct query for livestreams: "+err.Error())
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
 
 	livestreams, err := bulkFillLivestreamResponse(ctx, tx, livestreamModels)
 	if err != nil {
@@ -237,6 +549,7 @@ func searchLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	c.Response().Header().Set(totalCountHeader, strconv.FormatInt(totalCount, 10))
 	return c.JSON(http.StatusOK, livestreams)
 }
 
@@ -300,8 +613,9 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		}
 	}
 
+	// コラボレーターとして参加する配信も含める
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? OR id IN (SELECT livestream_id FROM livestream_collaborators WHERE user_id = ?)", user.ID, user.ID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 	livestreams := make([]Livestream, len(livestreamModels))
@@ -344,6 +658,17 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err := livestreamModel.ensureNotEnded(); err != nil {
+		return err
+	}
+
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
@@ -353,11 +678,19 @@ func enterLivestreamHandler(c echo.Context) error {
 	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
+	// 配信開始通知の宛先として、退出後も残しておく
+	if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO streamer_viewers (streamer_id, user_id, created_at) VALUES (?, ?, ?)", livestreamModel.UserID, viewer.UserID, viewer.CreatedAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert streamer_viewers: "+err.Error())
+	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if err := publishViewerEvent(ctx, LivestreamEventViewerEnter, userID, int64(livestreamID)); err != nil {
+		c.Logger().Warnf("failed to publish viewer_enter event: %+v", err)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -392,6 +725,10 @@ func exitLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if err := publishViewerEvent(ctx, LivestreamEventViewerExit, userID, int64(livestreamID)); err != nil {
+		c.Logger().Warnf("failed to publish viewer_exit event: %+v", err)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -462,7 +799,11 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	// existence already check
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	if livestreamModel.UserID != userID {
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+	if !canModerate {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
 
@@ -493,11 +834,22 @@ func bulkFillLivestreamResponse(ctx context.Context, tx sqlx.QueryerContext, liv
 	}
 
 	livestreams := make([]Livestream, len(livestreamModels))
+	livestreamIds := make([]int64, len(livestreamModels))
 	userIds := make([]int64, len(livestreamModels))
 	for i, livestreamModel := range livestreamModels {
+		livestreamIds[i] = livestreamModel.ID
 		userIds[i] = livestreamModel.UserID
 	}
 
+	// コラボレーターもまとめてusersから引く
+	collaboratorIDsByLivestreamId, err := bulkGetCollaboratorIDsByLivestream(ctx, tx, livestreamIds)
+	if err != nil {
+		return nil, fmt.Errorf("bulkGetCollaboratorIDsByLivestream: %w", err)
+	}
+	for _, collaboratorIDs := range collaboratorIDsByLivestreamId {
+		userIds = append(userIds, collaboratorIDs...)
+	}
+
 	userModels := []UserModel{}
 	{
 		query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIds)
@@ -517,6 +869,7 @@ func bulkFillLivestreamResponse(ctx context.Context, tx sqlx.QueryerContext, liv
 		return nil, fmt.Errorf("bulkGetTagsByLivestream: %w", err)
 	}
 
+	now := time.Now().Unix()
 	for i, livestreamModel := range livestreamModels {
 		owner, ok := userById[livestreamModel.UserID]
 		if !ok {
@@ -525,16 +878,27 @@ func bulkFillLivestreamResponse(ctx context.Context, tx sqlx.QueryerContext, liv
 
 		tags := tagsByLivestreamId[livestreamModel.ID]
 
+		collaborators := make([]User, 0, len(collaboratorIDsByLivestreamId[livestreamModel.ID]))
+		for _, collaboratorID := range collaboratorIDsByLivestreamId[livestreamModel.ID] {
+			collaborator, ok := userById[collaboratorID]
+			if !ok {
+				return nil, fmt.Errorf("collaborator not found (id=%d)", collaboratorID)
+			}
+			collaborators = append(collaborators, collaborator)
+		}
+
 		livestream := Livestream{
-			ID:           livestreamModel.ID,
-			Owner:        owner,
-			Title:        livestreamModel.Title,
-			Tags:         tags,
-			Description:  livestreamModel.Description,
-			PlaylistUrl:  livestreamModel.PlaylistUrl,
-			ThumbnailUrl: livestreamModel.ThumbnailUrl,
-			StartAt:      livestreamModel.StartAt,
-			EndAt:        livestreamModel.EndAt,
+			ID:            livestreamModel.ID,
+			Owner:         owner,
+			Title:         livestreamModel.Title,
+			Tags:          tags,
+			Collaborators: collaborators,
+			Description:   livestreamModel.Description,
+			PlaylistUrl:   livestreamModel.PlaylistUrl,
+			ThumbnailUrl:  livestreamModel.ThumbnailUrl,
+			StartAt:       livestreamModel.StartAt,
+			EndAt:         livestreamModel.EndAt,
+			Status:        livestreamModel.Status(now),
 		}
 
 		livestreams[i] = livestream
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	RecurrenceDaily  = "daily"
+	RecurrenceWeekly = "weekly"
+
+	// 一度に予約できる繰り返し回数の上限
+	maxRecurrenceOccurrences = 100
+)
+
+// 繰り返し予約のルール
+// count か until の少なくとも一方を指定する。両方指定した場合は先に達した方で打ち切る
+type RecurrenceRule struct {
+	Frequency string `json:"frequency"`
+	// 初回を含めた回数
+	Count int `json:"count"`
+	// この時刻以前に始まる回まで予約する
+	Until int64 `json:"until"`
+	// trueなら1回でも予約できなければ全て取り消す
+	AllOrNothing bool `json:"all_or_nothing"`
+}
+
+type ReservationOccurrence struct {
+	StartAt    int64       `json:"start_at"`
+	EndAt      int64       `json:"end_at"`
+	Reserved   bool        `json:"reserved"`
+	Livestream *Livestream `json:"livestream,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+type ReserveRecurringLivestreamsResponse struct {
+	Occurrences []ReservationOccurrence `json:"occurrences"`
+}
+
+// 繰り返しルールから各回の予約区間を求める
+func (r *RecurrenceRule) Occurrences(startAt, endAt int64) ([]ReservationRange, error) {
+	var interval int64
+	switch r.Frequency {
+	case RecurrenceDaily:
+		interval = int64(24 * time.Hour / time.Second)
+	case RecurrenceWeekly:
+		interval = int64(7 * 24 * time.Hour / time.Second)
+	default:
+		return nil, fmt.Errorf("recurrence frequency must be %q or %q", RecurrenceDaily, RecurrenceWeekly)
+	}
+	if r.Count <= 0 && r.Until == 0 {
+		return nil, fmt.Errorf("either recurrence count or until must be specified")
+	}
+	if r.Count < 0 || r.Count > maxRecurrenceOccurrences {
+		return nil, fmt.Errorf("recurrence count must be between 1 and %d", maxRecurrenceOccurrences)
+	}
+	if r.Until != 0 && r.Until < startAt {
+		return nil, fmt.Errorf("recurrence until must not be before start_at")
+	}
+
+	var ranges []ReservationRange
+	for i := int64(0); ; i++ {
+		occurrence := ReservationRange{StartAt: startAt + interval*i, EndAt: endAt + interval*i}
+		if r.Count > 0 && len(ranges) >= r.Count {
+			break
+		}
+		if r.Until != 0 && occurrence.StartAt > r.Until {
+			break
+		}
+		if len(ranges) >= maxRecurrenceOccurrences {
+			return nil, fmt.Errorf("recurrence must not exceed %d occurrences", maxRecurrenceOccurrences)
+		}
+		ranges = append(ranges, occurrence)
+	}
+	return ranges, nil
+}
+
+// 繰り返し予約を1トランザクションで行う
+// POST /api/livestream/reservation (recurrence指定時)
+func reserveRecurringLivestreamsHandler(c echo.Context, userID int64, req *ReserveLivestreamRequest) error {
+	ctx := c.Request().Context()
+
+	ranges, err := req.Recurrence.Occurrences(req.StartAt, req.EndAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := lockTags(ctx, tx, req.Tags); err != nil {
+		return err
+	}
+
+	// 全ての回の予約枠をまとめてロックする
+	if _, err := lockReservationSlots(ctx, tx, ranges...); err != nil {
+		return err
+	}
+
+	var (
+		occurrences      = make([]ReservationOccurrence, len(ranges))
+		livestreamModels []*LivestreamModel
+		failed           bool
+	)
+	for i, r := range ranges {
+		occurrences[i] = ReservationOccurrence{StartAt: r.StartAt, EndAt: r.EndAt}
+
+		var livestreamModel *LivestreamModel
+		err := validateReservationTerm(r.StartAt, r.EndAt)
+		if err == nil {
+			livestreamModel, err = reserveLivestream(ctx, tx, userID, req, r)
+		}
+		if err != nil {
+			he, ok := err.(*echo.HTTPError)
+			if !ok || he.Code >= http.StatusInternalServerError {
+				return err
+			}
+			// 予約枠不足など、その回だけの失敗
+			occurrences[i].Error = fmt.Sprint(he.Message)
+			failed = true
+			continue
+		}
+		occurrences[i].Reserved = true
+		livestreamModels = append(livestreamModels, livestreamModel)
+	}
+
+	if failed && req.Recurrence.AllOrNothing {
+		// ロールバックされるので、全ての回を未予約として返す
+		for i := range occurrences {
+			occurrences[i].Reserved = false
+		}
+		return c.JSON(http.StatusBadRequest, &ReserveRecurringLivestreamsResponse{Occurrences: occurrences})
+	}
+	if len(livestreamModels) == 0 {
+		return c.JSON(http.StatusBadRequest, &ReserveRecurringLivestreamsResponse{Occurrences: occurrences})
+	}
+
+	livestreams, err := bulkFillLivestreamResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to bulkFillLivestreamResponse: "+err.Error())
+	}
+	j := 0
+	for i := range occurrences {
+		if occurrences[i].Reserved {
+			occurrences[i].Livestream = &livestreams[j]
+			j++
+		}
+	}
+	for _, livestream := range livestreams {
+		if err := enqueueWebhookEvent(ctx, tx, userID, WebhookEventReservationCreated, livestream); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, &ReserveRecurringLivestreamsResponse{Occurrences: occurrences})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	LivestreamSortNewest       = "newest"
+	LivestreamSortStartingSoon = "starting_soon"
+	LivestreamSortPopular      = "popular"
+
+	TagMatchAny = "any"
+	TagMatchAll = "all"
+
+	totalCountHeader = "X-Total-Count"
+)
+
+// 人気順はランキングと同じく、リアクション数とチップ合計の和で並べる
+const livestreamPopularityScore = `(
+	(SELECT COUNT(*) FROM reactions r WHERE r.livestream_id = livestreams.id) +
+	(SELECT IFNULL(SUM(lc.tip), 0) FROM livecomments lc WHERE lc.livestream_id = livestreams.id)
+)`
+
+var livestreamSortOrders = map[string]string{
+	LivestreamSortNewest:       "id DESC",
+	LivestreamSortStartingSoon: "start_at ASC, id ASC",
+	LivestreamSortPopular:      livestreamPopularityScore + " DESC, id DESC",
+}
+
+// 配信検索の条件
+type LivestreamSearchQuery struct {
+	where  []string
+	args   []interface{}
+	order  string
+	limit  int
+	offset int
+}
+
+// GET /api/livestream/search のクエリパラメータを解釈する
+//
+//	keyword:     タイトル・説明文の部分一致
+//	tag:         タグ名 (複数指定可)
+//	tag_match:   any (いずれかのタグ) / all (全てのタグ)
+//	owner:       配信者のユーザ名
+//	start_from:  start_at >= start_from
+//	start_to:    start_at < start_to
+//	status:      scheduled / live / ended
+//	sort:        newest / starting_soon / popular
+//	limit, offset
+func parseLivestreamSearchQuery(c echo.Context) (*LivestreamSearchQuery, error) {
+	q := &LivestreamSearchQuery{
+		order: livestreamSortOrders[LivestreamSortNewest],
+	}
+
+	if keyword := c.QueryParam("keyword"); keyword != "" {
+		pattern := "%" + escapeLike(keyword) + "%"
+		q.where = append(q.where, "(title LIKE ? OR description LIKE ?)")
+		q.args = append(q.args, pattern, pattern)
+	}
+
+	if tagNames := c.QueryParams()["tag"]; len(tagNames) > 0 {
+		tagMatch := c.QueryParam("tag_match")
+		if tagMatch == "" {
+			tagMatch = TagMatchAny
+		}
+		if tagMatch != TagMatchAny && tagMatch != TagMatchAll {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "tag_match must be any or all")
+		}
+
+		names := []string{}
+		seen := map[string]struct{}{}
+		for _, name := range tagNames {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+
+		// タグ名はtagsテーブルと突き合わせる
+		// 存在しないタグ名はどの配信にも一致しないので、allでは結果が空になる
+		if tagMatch == TagMatchAll {
+			q.where = append(q.where, "id IN (SELECT lt.livestream_id FROM livestream_tags lt INNER JOIN tags t ON t.id = lt.tag_id WHERE t.name IN (?) GROUP BY lt.livestream_id HAVING COUNT(DISTINCT t.id) = ?)")
+			q.args = append(q.args, names, len(names))
+		} else {
+			q.where = append(q.where, "id IN (SELECT lt.livestream_id FROM livestream_tags lt INNER JOIN tags t ON t.id = lt.tag_id WHERE t.name IN (?))")
+			q.args = append(q.args, names)
+		}
+	}
+
+	if owner := c.QueryParam("owner"); owner != "" {
+		q.where = append(q.where, "user_id = (SELECT id FROM users WHERE name = ?)")
+		q.args = append(q.args, owner)
+	}
+
+	if v := c.QueryParam("start_from"); v != "" {
+		startFrom, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "start_from query parameter must be integer")
+		}
+		q.where = append(q.where, "start_at >= ?")
+		q.args = append(q.args, startFrom)
+	}
+	if v := c.QueryParam("start_to"); v != "" {
+		startTo, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "start_to query parameter must be integer")
+		}
+		q.where = append(q.where, "start_at < ?")
+		q.args = append(q.args, startTo)
+	}
+
+	if status := c.QueryParam("status"); status != "" {
+		cond, args, err := livestreamStatusCondition(status, time.Now().Unix())
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		q.where = append(q.where, cond)
+		q.args = append(q.args, args...)
+	}
+
+	if sort := c.QueryParam("sort"); sort != "" {
+		order, ok := livestreamSortOrders[sort]
+		if !ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("sort must be one of %s, %s and %s", LivestreamSortNewest, LivestreamSortStartingSoon, LivestreamSortPopular))
+		}
+		q.order = order
+	}
+
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		}
+		if limit < 1 || limit > maxPageLimit {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be between 1 and %d", maxPageLimit))
+		}
+		q.limit = limit
+	}
+	if v := c.QueryParam("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
+		}
+		q.offset = offset
+	}
+
+	return q, nil
+}
+
+func (q *LivestreamSearchQuery) whereClause() string {
+	if len(q.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.where, " AND ")
+}
+
+// 検索結果を取得するクエリ
+func (q *LivestreamSearchQuery) SelectQuery() (string, []interface{}, error) {
+	query := "SELECT * FROM livestreams" + q.whereClause() + " ORDER BY " + q.order
+	args := append([]interface{}{}, q.args...)
+	if q.limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, q.limit, q.offset)
+	} else if q.offset > 0 {
+		// MySQLはLIMITなしのOFFSETを書けない
+		query += " LIMIT 18446744073709551615 OFFSET ?"
+		args = append(args, q.offset)
+	}
+	return sqlx.In(query, args...)
+}
+
+// ページングを無視した件数を取得するクエリ
+func (q *LivestreamSearchQuery) CountQuery() (string, []interface{}, error) {
+	return sqlx.In("SELECT COUNT(*) FROM livestreams"+q.whereClause(), q.args...)
+}
+
+// LIKEのワイルドカードをエスケープする
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
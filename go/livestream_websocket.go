@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	WebSocketMessageLivecomment = "livecomment"
+	WebSocketMessageReaction    = "reaction"
+	WebSocketMessageError       = "error"
+
+	// 受信がなくても、この間隔でセッションが失効していないか確認する
+	webSocketSessionCheckInterval = 30 * time.Second
+)
+
+// クライアントからWebSocketで送られてくるメッセージ
+type WebSocketClientMessage struct {
+	Type      string `json:"type"`
+	Comment   string `json:"comment"`
+	Tip       int64  `json:"tip"`
+	EmojiName string `json:"emoji_name"`
+}
+
+type WebSocketErrorMessage struct {
+	Type   string `json:"type"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// 配信ごとのWebSocket API
+// ライブコメント、リアクション、視聴者の入退室、コメント削除をまとめて配信し、
+// ライブコメントとリアクションの投稿も受け付ける
+// GET /api/livestream/:livestream_id/ws
+func livestreamWebSocketHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	sessionID := sess.Values[defaultSessionIDKey].(string)
+
+	id, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livestreamID := int64(id)
+
+	var count int
+	if err := dbConn.GetContext(ctx, &count, "SELECT COUNT(*) FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if count == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+	}
+
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			if err := verifyWebSocketOrigin(config, req); err != nil {
+				return err
+			}
+			// ServeHTTPはc.Response()を使わずにハンドシェイクの応答を書くので、
+			// verifyUserSessionで延長したセッションのCookieはここで載せる
+			if cookies := c.Response().Header().Values(echo.HeaderSetCookie); len(cookies) > 0 {
+				config.Header = http.Header{echo.HeaderSetCookie: cookies}
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			ch := livestreamEventHub.Subscribe(livestreamID)
+			defer livestreamEventHub.Unsubscribe(livestreamID, ch)
+
+			// 書き込みはこのgoroutineだけで行い、受信側からの応答はrepliesで受け取る
+			replies := make(chan *WebSocketErrorMessage, 1)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					var msg WebSocketClientMessage
+					if err := websocket.JSON.Receive(ws, &msg); err != nil {
+						return
+					}
+					if reply := handleWebSocketClientMessage(c, sessionID, userID, livestreamID, msg); reply != nil {
+						select {
+						case replies <- reply:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+			}()
+
+			sessionCheck := time.NewTicker(webSocketSessionCheckInterval)
+			defer sessionCheck.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				case <-sessionCheck.C:
+					// ログアウト・パスワード変更・退会で失効したセッションの接続は切る
+					if _, err := verifyServerSession(ctx, sessionID, userID, time.Now()); err != nil {
+						websocket.JSON.Send(ws, newWebSocketErrorMessage(err))
+						return
+					}
+				case reply := <-replies:
+					if err := websocket.JSON.Send(ws, reply); err != nil {
+						return
+					}
+					if reply.Status == http.StatusUnauthorized {
+						return
+					}
+				case event, ok := <-ch:
+					if !ok {
+						// hubから切断された
+						return
+					}
+					if err := websocket.JSON.Send(ws, event); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// 投稿に成功した場合はhub経由で本人にも届くので、失敗時のみ応答を返す
+// セッションが失効していたら401を返し、接続を切ってもらう
+func handleWebSocketClientMessage(c echo.Context, sessionID string, userID, livestreamID int64, msg WebSocketClientMessage) *WebSocketErrorMessage {
+	ctx := c.Request().Context()
+
+	if _, err := verifyServerSession(ctx, sessionID, userID, time.Now()); err != nil {
+		return newWebSocketErrorMessage(err)
+	}
+
+	var err error
+	switch msg.Type {
+	case WebSocketMessageLivecomment:
+		_, err = postLivecomment(ctx, c.Logger(), userID, livestreamID, &PostLivecommentRequest{
+			Comment: msg.Comment,
+			Tip:     msg.Tip,
+		})
+	case WebSocketMessageReaction:
+		_, err = postReaction(ctx, userID, livestreamID, &PostReactionRequest{
+			EmojiName: msg.EmojiName,
+		})
+	default:
+		err = echo.NewHTTPError(http.StatusBadRequest, "unknown message type: "+msg.Type)
+	}
+	if err == nil {
+		return nil
+	}
+
+	c.Logger().Errorf("error at websocket %s: %+v", c.Path(), err)
+	return newWebSocketErrorMessage(err)
+}
+
+func newWebSocketErrorMessage(err error) *WebSocketErrorMessage {
+	reply := &WebSocketErrorMessage{
+		Type:   WebSocketMessageError,
+		Status: http.StatusInternalServerError,
+		Error:  err.Error(),
+	}
+	if he, ok := err.(*echo.HTTPError); ok {
+		reply.Status = he.Code
+		reply.Error = fmt.Sprint(he.Message)
+	}
+	return reply
+}
+
+// Cookieで認証しているので、別オリジンからの接続は拒否する
+func verifyWebSocketOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return fmt.Errorf("null origin")
+	}
+	if origin.Host != req.Host {
+		return fmt.Errorf("cross origin websocket request: %s", origin.String())
+	}
+	config.Origin = origin
+	return nil
+}
@@ -135,6 +135,15 @@ func initializeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
+	if err := tagCache.Load(c.Request().Context(), dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error())
+	}
+	if embeddedDNSProvider, ok := dnsProvider.(*EmbeddedDNSProvider); ok {
+		if err := embeddedDNSProvider.Load(c.Request().Context(), dbConn); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to load dns records: "+err.Error())
+		}
+	}
+
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
@@ -189,8 +198,20 @@ func main() {
 	e := echo.New()
 	e.Logger.SetLevel(echolog.DEBUG)
 	// e.Use(middleware.Logger())
+	sessionConf, err := loadSessionConfig()
+	if err != nil {
+		e.Logger.Errorf("failed to load session config: %v", err)
+		os.Exit(1)
+	}
+	sessionConfig = sessionConf
+	cost, err := loadBcryptCost()
+	if err != nil {
+		e.Logger.Errorf("failed to load bcrypt cost: %v", err)
+		os.Exit(1)
+	}
+	bcryptCost = cost
 	cookieStore := sessions.NewCookieStore(secret)
-	cookieStore.Options.Domain = "*.u.isucon.dev"
+	cookieStore.Options = sessionConfig.StoreOptions()
 	e.Use(session.Middleware(cookieStore))
 	// e.Use(middleware.Recover())
 	e.Use(otelecho.Middleware("isucon13"))
@@ -200,19 +221,40 @@ func main() {
 
 	// top
 	e.GET("/api/tag", getTagHandler)
+	// 人気のタグ
+	e.GET("/api/tag/trending", getTrendingTagsHandler)
+	// (管理者向け)タグの管理
+	e.POST("/api/admin/tags", postTagHandler)
+	e.PATCH("/api/admin/tags/:tag_id", renameTagHandler)
+	e.POST("/api/admin/tags/:tag_id/merge", mergeTagHandler)
+	e.POST("/api/admin/tags/:tag_id/retire", retireTagHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
 
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	// 予約枠の空き状況
+	e.GET("/api/reservation_slots", getReservationSlotsHandler)
+	e.GET("/api/reservation_slots/available", searchAvailableWindowHandler)
+	// (管理者向け)予約枠の生成
+	e.POST("/api/admin/reservation_slots", generateReservationSlotsHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	// 配信予約の変更・キャンセル
+	e.PATCH("/api/livestream/:livestream_id", updateLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id", cancelLivestreamHandler)
+	// 配信のタグの付け替え
+	e.PUT("/api/livestream/:livestream_id/tags", putLivestreamTagsHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	// ライブコメントのSSE配信
+	e.GET("/api/livestream/:livestream_id/livecomment/stream", streamLivecommentsHandler)
+	// ライブコメント・リアクション・視聴者数をまとめて送受信するWebSocket
+	e.GET("/api/livestream/:livestream_id/ws", livestreamWebSocketHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
@@ -235,12 +277,39 @@ func main() {
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
+	e.POST("/api/logout", logoutHandler)
+	// ログイン中のセッションの一覧・失効
+	e.GET("/api/user/me/sessions", getUserSessionsHandler)
+	e.DELETE("/api/user/me/sessions", revokeAllUserSessionsHandler)
+	e.DELETE("/api/user/me/sessions/:session_id", revokeUserSessionHandler)
 	e.GET("/api/user/me", getMeHandler)
+	// プロフィールの変更
+	e.PATCH("/api/user/me", patchMeHandler)
+	e.POST("/api/user/me/password", postPasswordHandler)
+	// 退会
+	e.DELETE("/api/user/me", deleteMeHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
 	e.POST("/api/icon", postIconHandler)
+	// フォロー
+	e.POST("/api/user/:username/follow", followHandler)
+	e.DELETE("/api/user/:username/follow", unfollowHandler)
+	e.GET("/api/user/:username/followers", getFollowersHandler)
+	e.GET("/api/user/:username/following", getFollowingHandler)
+	// フォロー中のユーザの配信一覧
+	e.GET("/api/feed", getFeedHandler)
+
+	// 通知
+	e.GET("/api/notifications", getNotificationsHandler)
+	e.POST("/api/notifications/read", readNotificationsHandler)
+
+	// Webhook
+	e.POST("/api/webhooks", postWebhookHandler)
+	e.GET("/api/webhooks", getWebhooksHandler)
+	e.DELETE("/api/webhooks/:webhook_id", deleteWebhookHandler)
+	e.GET("/api/webhooks/:webhook_id/deliveries", getWebhookDeliveriesHandler)
 
 	// stats
 	// ライブ配信統計情報
@@ -267,6 +336,108 @@ func main() {
 	}
 	powerDNSSubdomainAddress = subdomainAddr
 
+	dnsServerConf, err := loadDNSServerConfig()
+	if err != nil {
+		e.Logger.Errorf("failed to load dns server config: %v", err)
+		os.Exit(1)
+	}
+	dnsServerConfig = dnsServerConf
+	if dnsServerConfig.Enabled {
+		// 組み込みDNSサーバを使う場合は、PowerDNSには書き込まない
+		embeddedDNSProvider := newEmbeddedDNSProvider(dbConn)
+		if err := embeddedDNSProvider.Load(ctx, dbConn); err != nil {
+			e.Logger.Errorf("failed to load dns records: %v", err)
+			os.Exit(1)
+		}
+		dnsProvider = embeddedDNSProvider
+	} else {
+		provider, err := newDNSProvider()
+		if err != nil {
+			e.Logger.Errorf("failed to initialize dns provider: %v", err)
+			os.Exit(1)
+		}
+		dnsProvider = provider
+	}
+
+	zone, err := loadStaticZone(powerDNSSubdomainAddress)
+	if err != nil {
+		e.Logger.Errorf("failed to load zone file: %v", err)
+		os.Exit(1)
+	}
+	staticZone = zone
+	reservedUsernames = loadReservedUsernames(staticZone)
+
+	// ./isupipe reconcile-dns で、ユーザとDNSレコードを一度だけ突き合わせて終了する
+	if len(os.Args) > 1 && os.Args[1] == "reconcile-dns" {
+		result, err := reconcileDNSRecords(ctx)
+		if err != nil {
+			e.Logger.Errorf("failed to reconcile dns records: %v", err)
+			os.Exit(1)
+		}
+		if result.Skipped {
+			fmt.Println("skipped: another host is reconciling")
+			return
+		}
+		fmt.Printf("added: %d, updated: %d, deleted: %d\n", len(result.Added), len(result.Updated), len(result.Deleted))
+		return
+	}
+
+	reconcileInterval, err := loadDNSReconcileInterval()
+	if err != nil {
+		e.Logger.Errorf("failed to load dns reconcile config: %v", err)
+		os.Exit(1)
+	}
+	dnsReconcileInterval = reconcileInterval
+	startDNSReconciler(e.Logger)
+
+	if embeddedDNSProvider, ok := dnsProvider.(*EmbeddedDNSProvider); ok {
+		dnsServer, err := newDNSServer(dnsServerConfig, embeddedDNSProvider, staticZone)
+		if err != nil {
+			e.Logger.Errorf("failed to initialize dns server: %v", err)
+			os.Exit(1)
+		}
+		if err := startDNSServer(e.Logger, dnsServer); err != nil {
+			e.Logger.Errorf("failed to start dns server: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	reservationConf, err := loadReservationConfig()
+	if err != nil {
+		e.Logger.Errorf("failed to load reservation config: %v", err)
+		os.Exit(1)
+	}
+	reservationConfig = reservationConf
+
+	if err := tagCache.Load(context.Background(), dbConn); err != nil {
+		e.Logger.Errorf("failed to load tags: %v", err)
+		os.Exit(1)
+	}
+	tagCacheInterval, err := loadTagCacheReloadInterval()
+	if err != nil {
+		e.Logger.Errorf("failed to load tag cache config: %v", err)
+		os.Exit(1)
+	}
+	tagCacheReloadInterval = tagCacheInterval
+	startTagCacheReloader(e.Logger)
+
+	trendingTagsConf, err := loadTrendingTagsConfig()
+	if err != nil {
+		e.Logger.Errorf("failed to load trending tags config: %v", err)
+		os.Exit(1)
+	}
+	trendingTagsConfig = trendingTagsConf
+	startTrendingTagsRefresher(e.Logger)
+
+	notificationInterval, err := loadNotificationSchedulerInterval()
+	if err != nil {
+		e.Logger.Errorf("failed to load notification config: %v", err)
+		os.Exit(1)
+	}
+	notificationSchedulerInterval = notificationInterval
+	startNotificationScheduler(e.Logger)
+	startWebhookDispatcher(e.Logger)
+
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
 	if err := e.Start(listenAddr); err != nil {
@@ -277,12 +448,18 @@ func main() {
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// エラーの理由 (クライアントが判別できるもののみ)
+	Reason string `json:"reason,omitempty"`
 }
 
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
 	if he, ok := err.(*echo.HTTPError); ok {
-		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
+		res := &ErrorResponse{Error: err.Error()}
+		if re, ok := he.Internal.(*ReasonError); ok {
+			res = &ErrorResponse{Error: fmt.Sprintf("code=%d, message=%v", he.Code, he.Message), Reason: re.Reason}
+		}
+		if e := c.JSON(he.Code, res); e != nil {
 			c.Logger().Errorf("%+v", e)
 		}
 		return
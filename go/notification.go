@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	NotificationLivestreamStarted   = "livestream_started"
+	NotificationMention             = "mention"
+	NotificationLivecommentReported = "livecomment_reported"
+
+	notificationSchedulerIntervalSecondsEnvKey = "ISUCON13_NOTIFICATION_SCHEDULER_INTERVAL_SECONDS"
+
+	// 1つのライブコメントで通知するメンションの上限
+	maxMentionsPerLivecomment = 10
+	defaultNotificationsLimit = 50
+)
+
+var mentionPattern = regexp.MustCompile(`@([0-9A-Za-z_-]+)`)
+
+// 配信開始通知を作成する間隔
+var notificationSchedulerInterval = 5 * time.Second
+
+type NotificationModel struct {
+	ID            int64  `db:"id"`
+	UserID        int64  `db:"user_id"`
+	Type          string `db:"type"`
+	LivestreamID  int64  `db:"livestream_id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	ActorUserID   int64  `db:"actor_user_id"`
+	ReadAt        *int64 `db:"read_at"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+type Notification struct {
+	ID            int64  `json:"id"`
+	Type          string `json:"type"`
+	LivestreamID  int64  `json:"livestream_id,omitempty"`
+	LivecommentID int64  `json:"livecomment_id,omitempty"`
+	// 通知のきっかけになったユーザ (メンションしたユーザなど)
+	Actor     *User `json:"actor,omitempty"`
+	Read      bool  `json:"read"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+type NotificationsResponse struct {
+	Notifications []Notification `json:"notifications"`
+	UnreadCount   int64          `json:"unread_count"`
+}
+
+type ReadNotificationsRequest struct {
+	IDs []int64 `json:"ids"`
+	// trueなら未読の通知を全て既読にする
+	All bool `json:"all"`
+}
+
+func loadNotificationSchedulerInterval() (time.Duration, error) {
+	v, ok := os.LookupEnv(notificationSchedulerIntervalSecondsEnvKey)
+	if !ok {
+		return notificationSchedulerInterval, nil
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("environment variable '%s' must be positive integer", notificationSchedulerIntervalSecondsEnvKey)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// 同じ通知を重複して作らないよう、(user_id, type, livestream_id, livecomment_id) の一意制約に任せてINSERT IGNOREする
+const insertNotificationQuery = "INSERT IGNORE INTO notifications (user_id, type, livestream_id, livecomment_id, actor_user_id, created_at) VALUES (:user_id, :type, :livestream_id, :livecomment_id, :actor_user_id, :created_at)"
+
+// ライブコメント中の@usernameで指定されたユーザに通知する
+func notifyMentions(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel) error {
+	var names []string
+	seen := map[string]struct{}{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(livecommentModel.Comment, -1) {
+		if _, ok := seen[m[1]]; ok {
+			continue
+		}
+		seen[m[1]] = struct{}{}
+		names = append(names, m[1])
+		if len(names) >= maxMentionsPerLivecomment {
+			break
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("SELECT id FROM users WHERE name IN (?) AND id != ?", names, livecommentModel.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to construct IN query for users: %w", err)
+	}
+	var userIDs []int64
+	if err := tx.SelectContext(ctx, &userIDs, query, args...); err != nil {
+		return fmt.Errorf("failed to get mentioned users: %w", err)
+	}
+	for _, userID := range userIDs {
+		if _, err := tx.NamedExecContext(ctx, insertNotificationQuery, &NotificationModel{
+			UserID:        userID,
+			Type:          NotificationMention,
+			LivestreamID:  livecommentModel.LivestreamID,
+			LivecommentID: livecommentModel.ID,
+			ActorUserID:   livecommentModel.UserID,
+			CreatedAt:     livecommentModel.CreatedAt,
+		}); err != nil {
+			return fmt.Errorf("failed to insert mention notification: %w", err)
+		}
+	}
+	return nil
+}
+
+// 配信者に、配信内のライブコメントが報告されたことを通知する
+// 報告者は通知に含めない
+func notifyLivecommentReported(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, reportModel LivecommentReportModel) error {
+	if _, err := tx.NamedExecContext(ctx, insertNotificationQuery, &NotificationModel{
+		UserID:        livestreamModel.UserID,
+		Type:          NotificationLivecommentReported,
+		LivestreamID:  reportModel.LivestreamID,
+		LivecommentID: reportModel.LivecommentID,
+		CreatedAt:     reportModel.CreatedAt,
+	}); err != nil {
+		return fmt.Errorf("failed to insert report notification: %w", err)
+	}
+	return nil
+}
+
+// 開始時刻を迎えた配信について、その配信者の配信を視聴したことのあるユーザに通知する
+// どこまで通知したかはnotification_watermarksに残すので、停止中に開始した配信も次の実行で通知する
+// 複数のホストで動いていても、その行のロックで直列化される (通知自体も一意制約で重複しない)
+func notifyStartedLivestreams(ctx context.Context, db *sqlx.DB) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	var checkedUntil int64
+	if err := tx.GetContext(ctx, &checkedUntil, "SELECT checked_until FROM notification_watermarks WHERE name = ? FOR UPDATE", NotificationLivestreamStarted); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to get notification watermark: %w", err)
+		}
+		// 初回は、それより前に開始した配信を通知しない
+		checkedUntil = now - int64(notificationSchedulerInterval/time.Second)
+		if _, err := tx.ExecContext(ctx, "INSERT INTO notification_watermarks (name, checked_until) VALUES (?, ?)", NotificationLivestreamStarted, checkedUntil); err != nil {
+			return fmt.Errorf("failed to insert notification watermark: %w", err)
+		}
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE start_at > ? AND start_at <= ?", checkedUntil, now); err != nil {
+		return fmt.Errorf("failed to get started livestreams: %w", err)
+	}
+
+	for _, livestreamModel := range livestreamModels {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT IGNORE INTO notifications (user_id, type, livestream_id, livecomment_id, actor_user_id, created_at)
+			SELECT user_id, ?, ?, 0, ?, ?
+			FROM streamer_viewers
+			WHERE streamer_id = ? AND user_id != ?`,
+			NotificationLivestreamStarted, livestreamModel.ID, livestreamModel.UserID, livestreamModel.StartAt,
+			livestreamModel.UserID, livestreamModel.UserID,
+		); err != nil {
+			return fmt.Errorf("failed to insert livestream started notifications: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE notification_watermarks SET checked_until = ? WHERE name = ?", now, NotificationLivestreamStarted); err != nil {
+		return fmt.Errorf("failed to update notification watermark: %w", err)
+	}
+	return tx.Commit()
+}
+
+func startNotificationScheduler(logger echo.Logger) {
+	go func() {
+		ticker := time.NewTicker(notificationSchedulerInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := notifyStartedLivestreams(context.Background(), dbConn); err != nil {
+				logger.Errorf("failed to notify started livestreams: %v", err)
+			}
+		}
+	}()
+}
+
+// 通知一覧 (新しい順)
+// GET /api/notifications?unread=true&limit=&before_id=
+func getNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	query := "SELECT * FROM notifications WHERE user_id = ?"
+	args := []interface{}{userID}
+	if v := c.QueryParam("unread"); v != "" {
+		unread, err := strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "unread query parameter must be boolean")
+		}
+		if unread {
+			query += " AND read_at IS NULL"
+		}
+	}
+	if v := c.QueryParam("before_id"); v != "" {
+		beforeID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "before_id query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	limit, err := parseOptionalLimit(c)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		limit = defaultNotificationsLimit
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var notificationModels []NotificationModel
+	if err := tx.SelectContext(ctx, &notificationModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error())
+	}
+
+	var unreadCount int64
+	if err := tx.GetContext(ctx, &unreadCount, "SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count unread notifications: "+err.Error())
+	}
+
+	var actorIDs []int64
+	for _, notificationModel := range notificationModels {
+		if notificationModel.ActorUserID != 0 {
+			actorIDs = append(actorIDs, notificationModel.ActorUserID)
+		}
+	}
+	var actorModels []UserModel
+	if len(actorIDs) > 0 {
+		query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", actorIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for users: "+err.Error())
+		}
+		if err := tx.SelectContext(ctx, &actorModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+		}
+	}
+	actorById, err := bulkFillUserResponse(ctx, tx, actorModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to bulkFillUserResponse: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i, notificationModel := range notificationModels {
+		notification := Notification{
+			ID:            notificationModel.ID,
+			Type:          notificationModel.Type,
+			LivestreamID:  notificationModel.LivestreamID,
+			LivecommentID: notificationModel.LivecommentID,
+			Read:          notificationModel.ReadAt != nil,
+			CreatedAt:     notificationModel.CreatedAt,
+		}
+		if actor, ok := actorById[notificationModel.ActorUserID]; ok {
+			notification.Actor = &actor
+		}
+		notifications[i] = notification
+	}
+
+	return c.JSON(http.StatusOK, &NotificationsResponse{
+		Notifications: notifications,
+		UnreadCount:   unreadCount,
+	})
+}
+
+// 通知を既読にする
+// POST /api/notifications/read
+func readNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReadNotificationsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if !req.All && len(req.IDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "either ids or all must be specified")
+	}
+
+	now := time.Now().Unix()
+	if req.All {
+		if _, err := dbConn.ExecContext(ctx, "UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL", now, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notifications: "+err.Error())
+		}
+	} else {
+		query, args, err := sqlx.In("UPDATE notifications SET read_at = ? WHERE user_id = ? AND id IN (?) AND read_at IS NULL", now, userID, req.IDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for notifications: "+err.Error())
+		}
+		if _, err := dbConn.ExecContext(ctx, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notifications: "+err.Error())
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maxPageLimit = 1000
+
+	nextCursorHeader = "X-Next-Cursor"
+)
+
+// (created_at, id) の組で位置を表すカーソル
+// Afterがtrueならその位置より新しいもの、falseなら古いものを指す
+type PageCursor struct {
+	After     bool
+	CreatedAt int64
+	ID        int64
+}
+
+func (p PageCursor) Encode() string {
+	direction := "b"
+	if p.After {
+		direction = "a"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%d", direction, p.CreatedAt, p.ID)))
+}
+
+func decodePageCursor(s string) (PageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return PageCursor{}, err
+	}
+	// "a:123:456" の形式
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 {
+		return PageCursor{}, fmt.Errorf("malformed cursor")
+	}
+	var cursor PageCursor
+	switch parts[0] {
+	case "a":
+		cursor.After = true
+	case "b":
+		cursor.After = false
+	default:
+		return PageCursor{}, fmt.Errorf("malformed cursor")
+	}
+	if cursor.CreatedAt, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return PageCursor{}, fmt.Errorf("malformed cursor: %w", err)
+	}
+	if cursor.ID, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return PageCursor{}, fmt.Errorf("malformed cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+// limit, before_id, after_id, cursor クエリパラメータ
+type PageQuery struct {
+	// 0なら無制限
+	Limit  int
+	Cursor *PageCursor
+}
+
+// tableはlivestream_idとcreated_atを持つテーブル名 (ユーザ入力を渡さないこと)
+func parsePageQuery(ctx context.Context, tx *sqlx.Tx, c echo.Context, table string, livestreamID int64) (PageQuery, error) {
+	q := PageQuery{}
+
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return PageQuery{}, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		}
+		if limit < 1 || limit > maxPageLimit {
+			return PageQuery{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be between 1 and %d", maxPageLimit))
+		}
+		q.Limit = limit
+	}
+
+	var (
+		beforeID = c.QueryParam("before_id")
+		afterID  = c.QueryParam("after_id")
+		cursor   = c.QueryParam("cursor")
+	)
+	given := 0
+	for _, v := range []string{beforeID, afterID, cursor} {
+		if v != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return PageQuery{}, echo.NewHTTPError(http.StatusBadRequest, "only one of before_id, after_id and cursor can be specified")
+	}
+
+	switch {
+	case cursor != "":
+		p, err := decodePageCursor(cursor)
+		if err != nil {
+			return PageQuery{}, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		q.Cursor = &p
+	case beforeID != "" || afterID != "":
+		after := afterID != ""
+		v := beforeID
+		if after {
+			v = afterID
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return PageQuery{}, echo.NewHTTPError(http.StatusBadRequest, "before_id and after_id query parameter must be integer")
+		}
+		var createdAt int64
+		if err := tx.GetContext(ctx, &createdAt, "SELECT created_at FROM "+table+" WHERE id = ? AND livestream_id = ?", id, livestreamID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return PageQuery{}, echo.NewHTTPError(http.StatusBadRequest, "the given before_id or after_id is not found in the livestream")
+			}
+			return PageQuery{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get cursor position: "+err.Error())
+		}
+		q.Cursor = &PageCursor{After: after, CreatedAt: createdAt, ID: id}
+	}
+
+	return q, nil
+}
+
+// baseにカーソル条件・並び順・LIMITを付け足す
+// after方向は古い順で取得するので、取得後にreverseRowsで新しい順に直すこと
+func (q PageQuery) BuildQuery(base string, args ...interface{}) (string, []interface{}) {
+	query := base
+	order := "DESC"
+	if q.Cursor != nil {
+		if q.Cursor.After {
+			query += " AND (created_at, id) > (?, ?)"
+			order = "ASC"
+		} else {
+			query += " AND (created_at, id) < (?, ?)"
+		}
+		args = append(args, q.Cursor.CreatedAt, q.Cursor.ID)
+	}
+	query += fmt.Sprintf(" ORDER BY created_at %s, id %s", order, order)
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	return query, args
+}
+
+func (q PageQuery) IsAfter() bool {
+	return q.Cursor != nil && q.Cursor.After
+}
+
+// 新しい順に並んだ結果から次のカーソルを求める
+// after方向はポーリングに使うので、結果があれば常に最新位置を返す
+func (q PageQuery) NextCursor(n int, newestCreatedAt, newestID, oldestCreatedAt, oldestID int64) *PageCursor {
+	if n == 0 {
+		return nil
+	}
+	if q.IsAfter() {
+		return &PageCursor{After: true, CreatedAt: newestCreatedAt, ID: newestID}
+	}
+	if q.Limit > 0 && n == q.Limit {
+		return &PageCursor{After: false, CreatedAt: oldestCreatedAt, ID: oldestID}
+	}
+	return nil
+}
+
+func setNextCursorHeader(c echo.Context, cursor *PageCursor) {
+	if cursor == nil {
+		return
+	}
+	c.Response().Header().Set(nextCursorHeader, cursor.Encode())
+}
+
+func reverseRows[T any](rows []T) {
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+}
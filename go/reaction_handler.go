@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -52,19 +53,24 @@ func getReactionsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+	page, err := parsePageQuery(ctx, tx, c, "reactions", int64(livestreamID))
+	if err != nil {
+		return err
 	}
+	query, args := page.BuildQuery("SELECT * FROM reactions WHERE livestream_id = ?", livestreamID)
 
 	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 	}
+	// 常に新しい順で返す
+	if page.IsAfter() {
+		reverseRows(reactionModels)
+	}
+	if n := len(reactionModels); n > 0 {
+		newest, oldest := reactionModels[0], reactionModels[n-1]
+		setNextCursorHeader(c, page.NextCursor(n, newest.CreatedAt, newest.ID, oldest.CreatedAt, oldest.ID))
+	}
 
 	reactions := make([]Reaction, len(reactionModels))
 	for i := range reactionModels {
@@ -105,40 +111,68 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	reaction, err := postReaction(ctx, userID, int64(livestreamID), req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, reaction)
+}
+
+// リアクションを投稿し、購読者に配信する
+// HTTP/WebSocketの両方から呼ばれるので、エラーはecho.NewHTTPErrorで返す
+func postReaction(ctx context.Context, userID, livestreamID int64, req *PostReactionRequest) (Reaction, error) {
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Reaction{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err := livestreamModel.ensureNotEnded(); err != nil {
+		return Reaction{}, err
+	}
+
 	reactionModel := ReactionModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
+		UserID:       userID,
+		LivestreamID: livestreamID,
 		EmojiName:    req.EmojiName,
 		CreatedAt:    time.Now().Unix(),
 	}
 
 	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
 	}
 
 	reactionID, err := result.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
 	}
 	reactionModel.ID = reactionID
 
 	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+	}
+
+	if err := enqueueWebhookEvent(ctx, tx, livestreamModel.UserID, WebhookEventReactionCreated, reaction); err != nil {
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to enqueue webhook: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, reaction)
+	publishReactionEvent(reaction)
+
+	return reaction, nil
 }
 
 func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
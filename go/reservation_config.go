@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	reservationTermStartAtEnvKey  = "ISUCON13_RESERVATION_TERM_START_AT"
+	reservationTermEndAtEnvKey    = "ISUCON13_RESERVATION_TERM_END_AT"
+	reservationSlotSecondsEnvKey  = "ISUCON13_RESERVATION_SLOT_SECONDS"
+	reservationSlotCapacityEnvKey = "ISUCON13_RESERVATION_SLOT_CAPACITY"
+)
+
+// 予約期間と予約枠の設定
+type ReservationConfig struct {
+	TermStartAt time.Time
+	TermEndAt   time.Time
+	// 予約枠1つあたりの長さ
+	SlotDuration time.Duration
+	// 予約枠を生成する際のデフォルトの枠数
+	SlotCapacity int64
+}
+
+// 環境変数がセットされていなかった場合は、初期データやベンチマーカーと同じ
+// 2023/11/25 10:00からの１年間、1時間5枠とする (init.shのデフォルトも同じ)
+var reservationConfig = ReservationConfig{
+	TermStartAt:  time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC),
+	TermEndAt:    time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC),
+	SlotDuration: time.Hour,
+	SlotCapacity: 5,
+}
+
+func loadReservationConfig() (ReservationConfig, error) {
+	conf := reservationConfig
+
+	if v, ok := os.LookupEnv(reservationTermStartAtEnvKey); ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return ReservationConfig{}, fmt.Errorf("failed to parse environment variable '%s' as RFC3339: %+v", reservationTermStartAtEnvKey, err)
+		}
+		conf.TermStartAt = t
+	}
+	if v, ok := os.LookupEnv(reservationTermEndAtEnvKey); ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return ReservationConfig{}, fmt.Errorf("failed to parse environment variable '%s' as RFC3339: %+v", reservationTermEndAtEnvKey, err)
+		}
+		conf.TermEndAt = t
+	}
+	if v, ok := os.LookupEnv(reservationSlotSecondsEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return ReservationConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", reservationSlotSecondsEnvKey)
+		}
+		conf.SlotDuration = time.Duration(seconds) * time.Second
+	}
+	if v, ok := os.LookupEnv(reservationSlotCapacityEnvKey); ok {
+		capacity, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || capacity < 0 {
+			return ReservationConfig{}, fmt.Errorf("environment variable '%s' must be non-negative integer", reservationSlotCapacityEnvKey)
+		}
+		conf.SlotCapacity = capacity
+	}
+
+	if !conf.TermStartAt.Before(conf.TermEndAt) {
+		return ReservationConfig{}, fmt.Errorf("reservation term start must be before its end")
+	}
+
+	return conf, nil
+}
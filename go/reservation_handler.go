@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 予約区間が予約期間と重なっているかチェック
+func validateReservationTerm(startAt, endAt int64) error {
+	var (
+		reserveStartAt = time.Unix(startAt, 0)
+		reserveEndAt   = time.Unix(endAt, 0)
+	)
+	if !reserveStartAt.Before(reserveEndAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	}
+	var (
+		termStartAt = reservationConfig.TermStartAt
+		termEndAt   = reservationConfig.TermEndAt
+	)
+	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	}
+	return nil
+}
+
+type ReservationRange struct {
+	StartAt int64
+	EndAt   int64
+}
+
+// 予約区間に含まれる予約枠をまとめてロックする
+// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+// デッドロックを避けるため、複数区間も一度のクエリでid順にロックする
+func lockReservationSlots(ctx context.Context, tx *sqlx.Tx, ranges ...ReservationRange) ([]*ReservationSlotModel, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	conds := make([]string, len(ranges))
+	args := make([]interface{}, 0, len(ranges)*2)
+	for i, r := range ranges {
+		conds[i] = "(start_at >= ? AND end_at <= ?)"
+		args = append(args, r.StartAt, r.EndAt)
+	}
+	query := "SELECT * FROM reservation_slots WHERE " + strings.Join(conds, " OR ") + " ORDER BY id FOR UPDATE"
+
+	var slots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slots, query, args...); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	return slots, nil
+}
+
+// 予約区間の予約枠を1つずつ確保する
+// 呼び出し前にlockReservationSlotsでロックしておくこと
+func takeReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM reservation_slots WHERE start_at >= ? AND end_at <= ? AND slot < 1", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", reservationConfig.TermStartAt.Unix(), reservationConfig.TermEndAt.Unix(), startAt, endAt))
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	return nil
+}
+
+// 予約区間の予約枠を1つずつ返却する
+// 呼び出し前にlockReservationSlotsでロックしておくこと
+func releaseReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	return nil
+}
+
+const (
+	// 一度に取得できる予約枠の範囲
+	maxReservationSlotsRange = 31 * 24 * 60 * 60
+	maxAvailableWindowHours  = 7 * 24
+	// 一度に生成できる予約枠の数
+	maxGenerateReservationSlots = 20000
+	// バルクインサートの単位
+	reservationSlotsInsertChunk = 1000
+)
+
+type ReservationSlot struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
+type GenerateReservationSlotsRequest struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+	// 省略時は設定されたデフォルトの枠数
+	Slot *int64 `json:"slot"`
+}
+
+type GenerateReservationSlotsResponse struct {
+	Created int `json:"created"`
+	Skipped int `json:"skipped"`
+}
+
+type AvailableWindow struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+}
+
+// 予約枠の空き状況取得API
+// GET /api/reservation_slots?from=&to=
+func getReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+	}
+	to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+	}
+	if from >= to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+	if to-from > maxReservationSlotsRange {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("range between from and to must be within %d seconds", maxReservationSlotsRange))
+	}
+
+	var slotModels []*ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slotModels, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", from, to); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	slots := make([]ReservationSlot, len(slotModels))
+	for i, slotModel := range slotModels {
+		slots[i] = ReservationSlot{
+			StartAt:   slotModel.StartAt,
+			EndAt:     slotModel.EndAt,
+			Remaining: slotModel.Slot,
+		}
+	}
+
+	return c.JSON(http.StatusOK, slots)
+}
+
+// 連続してN時間予約できる最初の区間を探すAPI
+// GET /api/reservation_slots/available?hours=&from=
+func searchAvailableWindowHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	hours, err := strconv.Atoi(c.QueryParam("hours"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "hours query parameter must be integer")
+	}
+	if hours < 1 || hours > maxAvailableWindowHours {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("hours query parameter must be between 1 and %d", maxAvailableWindowHours))
+	}
+
+	from := time.Now().Unix()
+	if v := c.QueryParam("from"); v != "" {
+		from, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+		}
+	}
+
+	var slotModels []*ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slotModels, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", from, reservationConfig.TermEndAt.Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	window, ok := findAvailableWindow(slotModels, int64(hours)*60*60)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no available window found")
+	}
+
+	return c.JSON(http.StatusOK, window)
+}
+
+// start_at順に並んだ予約枠から、空きのある枠がduration秒以上途切れずに続く最初の区間を返す
+func findAvailableWindow(slots []*ReservationSlotModel, duration int64) (AvailableWindow, bool) {
+	var (
+		running bool
+		window  AvailableWindow
+	)
+	for _, slot := range slots {
+		if slot.Slot < 1 || (running && slot.StartAt != window.EndAt) {
+			running = false
+		}
+		if slot.Slot < 1 {
+			continue
+		}
+		if !running {
+			running = true
+			window.StartAt = slot.StartAt
+		}
+		window.EndAt = slot.EndAt
+		if window.EndAt-window.StartAt >= duration {
+			return window, true
+		}
+	}
+	return AvailableWindow{}, false
+}
+
+// (管理者向け)予約枠生成API
+// fromから予約枠の長さごとに区切って、既存の枠と重ならないものだけ作成する
+// POST /api/admin/reservation_slots
+func generateReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	var req *GenerateReservationSlotsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	slotSeconds := int64(reservationConfig.SlotDuration / time.Second)
+	capacity := reservationConfig.SlotCapacity
+	if req.Slot != nil {
+		capacity = *req.Slot
+	}
+	if capacity < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "slot must be non-negative")
+	}
+	if req.From >= req.To {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+	termStartAt, termEndAt := reservationConfig.TermStartAt.Unix(), reservationConfig.TermEndAt.Unix()
+	if req.From < termStartAt || req.To > termEndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("from and to must be within the reservation term %d ~ %d", termStartAt, termEndAt))
+	}
+	// 既存の枠と境界がずれないよう、予約期間の開始から予約枠の長さ単位で揃える
+	if (req.From-termStartAt)%slotSeconds != 0 || (req.To-termStartAt)%slotSeconds != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("from and to must be aligned to %d seconds from the reservation term start", slotSeconds))
+	}
+	if (req.To-req.From)/slotSeconds > maxGenerateReservationSlots {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("cannot generate more than %d slots at once", maxGenerateReservationSlots))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var existingSlots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &existingSlots, "SELECT * FROM reservation_slots WHERE start_at < ? AND end_at > ? ORDER BY start_at FOR UPDATE", req.To, req.From); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	var (
+		newSlots []*ReservationSlotModel
+		skipped  int
+	)
+	for startAt := req.From; startAt+slotSeconds <= req.To; startAt += slotSeconds {
+		endAt := startAt + slotSeconds
+		overlapped := false
+		for _, existing := range existingSlots {
+			if existing.StartAt < endAt && startAt < existing.EndAt {
+				overlapped = true
+				break
+			}
+		}
+		if overlapped {
+			skipped++
+			continue
+		}
+		newSlots = append(newSlots, &ReservationSlotModel{
+			Slot:    capacity,
+			StartAt: startAt,
+			EndAt:   endAt,
+		})
+	}
+
+	for i := 0; i < len(newSlots); i += reservationSlotsInsertChunk {
+		chunk := newSlots[i:min(i+reservationSlotsInsertChunk, len(newSlots))]
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (:slot, :start_at, :end_at)", chunk); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation_slots: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, &GenerateReservationSlotsResponse{
+		Created: len(newSlots),
+		Skipped: skipped,
+	})
+}
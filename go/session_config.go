@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	sessionLifetimeSecondsEnvKey    = "ISUCON13_SESSION_LIFETIME_SECONDS"
+	sessionMaxLifetimeSecondsEnvKey = "ISUCON13_SESSION_MAX_LIFETIME_SECONDS"
+	sessionCookieDomainEnvKey       = "ISUCON13_SESSION_COOKIE_DOMAIN"
+	sessionCookieSecureEnvKey       = "ISUCON13_SESSION_COOKIE_SECURE"
+	sessionCookieHTTPOnlyEnvKey     = "ISUCON13_SESSION_COOKIE_HTTPONLY"
+	sessionCookieSameSiteEnvKey     = "ISUCON13_SESSION_COOKIE_SAMESITE"
+)
+
+// セッションとセッションクッキーの設定
+// ログイン・ログアウト・セッションの延長はすべてこの設定に従う
+type SessionConfig struct {
+	// 最後に延長してから操作がなければ失効するまでの時間
+	Lifetime time.Duration
+	// 延長を続けてもログインからこの時間が経てば失効する
+	MaxLifetime time.Duration
+
+	Domain   string
+	Secure   bool
+	HTTPOnly bool
+	SameSite http.SameSite
+}
+
+var sessionConfig = SessionConfig{
+	Lifetime:    time.Hour,
+	MaxLifetime: 7 * 24 * time.Hour,
+	Domain:      "u.isucon.dev",
+	Secure:      false,
+	HTTPOnly:    true,
+	SameSite:    http.SameSiteLaxMode,
+}
+
+func loadSessionConfig() (SessionConfig, error) {
+	conf := sessionConfig
+
+	if v, ok := os.LookupEnv(sessionLifetimeSecondsEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return SessionConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", sessionLifetimeSecondsEnvKey)
+		}
+		conf.Lifetime = time.Duration(seconds) * time.Second
+	}
+	if v, ok := os.LookupEnv(sessionMaxLifetimeSecondsEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return SessionConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", sessionMaxLifetimeSecondsEnvKey)
+		}
+		conf.MaxLifetime = time.Duration(seconds) * time.Second
+	}
+	if v, ok := os.LookupEnv(sessionCookieDomainEnvKey); ok {
+		conf.Domain = v
+	}
+	if v, ok := os.LookupEnv(sessionCookieSecureEnvKey); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return SessionConfig{}, fmt.Errorf("environment variable '%s' must be boolean", sessionCookieSecureEnvKey)
+		}
+		conf.Secure = b
+	}
+	if v, ok := os.LookupEnv(sessionCookieHTTPOnlyEnvKey); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return SessionConfig{}, fmt.Errorf("environment variable '%s' must be boolean", sessionCookieHTTPOnlyEnvKey)
+		}
+		conf.HTTPOnly = b
+	}
+	if v, ok := os.LookupEnv(sessionCookieSameSiteEnvKey); ok {
+		switch strings.ToLower(v) {
+		case "lax":
+			conf.SameSite = http.SameSiteLaxMode
+		case "strict":
+			conf.SameSite = http.SameSiteStrictMode
+		case "none":
+			conf.SameSite = http.SameSiteNoneMode
+		default:
+			return SessionConfig{}, fmt.Errorf("environment variable '%s' must be lax, strict or none", sessionCookieSameSiteEnvKey)
+		}
+	}
+
+	if conf.MaxLifetime < conf.Lifetime {
+		return SessionConfig{}, fmt.Errorf("session max lifetime must not be shorter than its lifetime")
+	}
+	// SameSite=Noneのクッキーはブラウザに捨てられる
+	if conf.SameSite == http.SameSiteNoneMode && !conf.Secure {
+		return SessionConfig{}, fmt.Errorf("SameSite=None session cookie must be Secure")
+	}
+
+	return conf, nil
+}
+
+func (sc SessionConfig) options(maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		Domain:   sc.Domain,
+		MaxAge:   maxAge,
+		Secure:   sc.Secure,
+		HttpOnly: sc.HTTPOnly,
+		SameSite: sc.SameSite,
+	}
+}
+
+// セッションストアのデフォルトのオプション
+// ログアウト時のクッキー削除もこのDomainで行われる
+func (sc SessionConfig) StoreOptions() *sessions.Options {
+	return sc.options(int(sc.Lifetime.Seconds()))
+}
+
+// expiresAtまで有効なクッキーのオプション
+func (sc SessionConfig) CookieOptions(now time.Time, expiresAt int64) *sessions.Options {
+	return sc.options(int(expiresAt - now.Unix()))
+}
+
+// ログイン時のセッションの期限
+func (sc SessionConfig) InitialExpiresAt(now time.Time) int64 {
+	return now.Add(sc.Lifetime).Unix()
+}
+
+// 延長後のセッションの期限を返す
+// 残りがLifetimeの半分を切るまでは延長しない (毎リクエストで書き込まないため)
+func (sc SessionConfig) RenewedExpiresAt(now time.Time, createdAt, expiresAt int64) (int64, bool) {
+	if time.Unix(expiresAt, 0).Sub(now) >= sc.Lifetime/2 {
+		return 0, false
+	}
+	renewed := now.Add(sc.Lifetime).Unix()
+	if limit := time.Unix(createdAt, 0).Add(sc.MaxLifetime).Unix(); renewed > limit {
+		renewed = limit
+	}
+	if renewed <= expiresAt {
+		return 0, false
+	}
+	return renewed, true
+}
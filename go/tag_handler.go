@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const maxTagNameLength = 255
+
+type PostTagRequest struct {
+	Name string `json:"name"`
+}
+
+type MergeTagRequest struct {
+	// 統合先のタグ
+	IntoTagID int64 `json:"into_tag_id"`
+}
+
+func validateTagName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "tag name must not be empty")
+	}
+	if utf8.RuneCountInString(name) > maxTagNameLength {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "tag name is too long")
+	}
+	return name, nil
+}
+
+// 他のタグが同じ名前を使っていないか確認する
+func ensureTagNameAvailable(ctx context.Context, tx *sqlx.Tx, name string, exceptID int64) error {
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM tags WHERE name = ? AND id != ?", name, exceptID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "tag name is already used")
+	}
+	return nil
+}
+
+func getTagForUpdate(ctx context.Context, tx *sqlx.Tx, tagID int64) (TagModel, error) {
+	var tagModel TagModel
+	if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ? FOR UPDATE", tagID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TagModel{}, echo.NewHTTPError(http.StatusNotFound, "tag not found")
+		}
+		return TagModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	return tagModel, nil
+}
+
+func parseTagIDParam(c echo.Context) (int64, error) {
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+	return tagID, nil
+}
+
+// コミット後にキャッシュを読み直す
+func reloadTagCache(ctx context.Context) error {
+	if err := tagCache.Load(ctx, dbConn); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reload tags: "+err.Error())
+	}
+	return nil
+}
+
+// (管理者向け)タグの作成
+// POST /api/admin/tags
+func postTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	var req *PostTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	name, err := validateTagName(req.Name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := ensureTagNameAvailable(ctx, tx, name, 0); err != nil {
+		return err
+	}
+
+	rs, err := tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?)", name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	if err := reloadTagCache(ctx); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, Tag{ID: tagID, Name: name})
+}
+
+// (管理者向け)タグ名の変更
+// PATCH /api/admin/tags/:tag_id
+func renameTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	tagID, err := parseTagIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req *PostTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	name, err := validateTagName(req.Name)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getTagForUpdate(ctx, tx, tagID); err != nil {
+		return err
+	}
+	if err := ensureTagNameAvailable(ctx, tx, name, tagID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET name = ? WHERE id = ?", name, tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	if err := reloadTagCache(ctx); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, Tag{ID: tagID, Name: name})
+}
+
+// (管理者向け)タグの統合
+// 統合元のタグが付いた配信を統合先のタグに付け替え、統合元のタグを削除する
+// POST /api/admin/tags/:tag_id/merge
+func mergeTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	tagID, err := parseTagIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req *MergeTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.IntoTagID == tagID {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot merge a tag into itself")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getTagForUpdate(ctx, tx, tagID); err != nil {
+		return err
+	}
+	intoTagModel, err := getTagForUpdate(ctx, tx, req.IntoTagID)
+	if err != nil {
+		return err
+	}
+	if intoTagModel.Retired {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot merge into a retired tag")
+	}
+
+	// 既に統合先のタグが付いている配信は、統合元のタグを外すだけでよい
+	if _, err := tx.ExecContext(ctx, "DELETE src FROM livestream_tags src JOIN livestream_tags dst ON src.livestream_id = dst.livestream_id AND dst.tag_id = ? WHERE src.tag_id = ?", intoTagModel.ID, tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete duplicated livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_tags SET tag_id = ? WHERE tag_id = ?", intoTagModel.ID, tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	if err := reloadTagCache(ctx); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, Tag{ID: intoTagModel.ID, Name: intoTagModel.Name})
+}
+
+// (管理者向け)タグの引退
+// 既存の配信からは外さないが、新しい配信には付与できなくなる
+// POST /api/admin/tags/:tag_id/retire
+func retireTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	tagID, err := parseTagIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := getTagForUpdate(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET retired = TRUE WHERE id = ?", tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	if err := reloadTagCache(ctx); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, Tag{ID: tagModel.ID, Name: tagModel.Name})
+}
@@ -1,107 +1,174 @@
 package main
 
-var tagsAll = map[int64]*Tag{
-	1:   &Tag{ID: 1, Name: "ライブ配信"},
-	2:   &Tag{ID: 2, Name: "ゲーム実況"},
-	3:   &Tag{ID: 3, Name: "生放送"},
-	4:   &Tag{ID: 4, Name: "アドバイス"},
-	5:   &Tag{ID: 5, Name: "初心者歓迎"},
-	6:   &Tag{ID: 6, Name: "プロゲーマー"},
-	7:   &Tag{ID: 7, Name: "新作ゲーム"},
-	8:   &Tag{ID: 8, Name: "レトロゲーム"},
-	9:   &Tag{ID: 9, Name: "RPG"},
-	10:  &Tag{ID: 10, Name: "FPS"},
-	11:  &Tag{ID: 11, Name: "アクションゲーム"},
-	12:  &Tag{ID: 12, Name: "対戦ゲーム"},
-	13:  &Tag{ID: 13, Name: "マルチプレイ"},
-	14:  &Tag{ID: 14, Name: "シングルプレイ"},
-	15:  &Tag{ID: 15, Name: "ゲーム解説"},
-	16:  &Tag{ID: 16, Name: "ホラーゲーム"},
-	17:  &Tag{ID: 17, Name: "イベント生放送"},
-	18:  &Tag{ID: 18, Name: "新情報発表"},
-	19:  &Tag{ID: 19, Name: "Q&Aセッション"},
-	20:  &Tag{ID: 20, Name: "チャット交流"},
-	21:  &Tag{ID: 21, Name: "視聴者参加"},
-	22:  &Tag{ID: 22, Name: "音楽ライブ"},
-	23:  &Tag{ID: 23, Name: "カバーソング"},
-	24:  &Tag{ID: 24, Name: "オリジナル楽曲"},
-	25:  &Tag{ID: 25, Name: "アコースティック"},
-	26:  &Tag{ID: 26, Name: "歌配信"},
-	27:  &Tag{ID: 27, Name: "楽器演奏"},
-	28:  &Tag{ID: 28, Name: "ギター"},
-	29:  &Tag{ID: 29, Name: "ピアノ"},
-	30:  &Tag{ID: 30, Name: "バンドセッション"},
-	31:  &Tag{ID: 31, Name: "DJセット"},
-	32:  &Tag{ID: 32, Name: "トーク配信"},
-	33:  &Tag{ID: 33, Name: "朝活"},
-	34:  &Tag{ID: 34, Name: "夜ふかし"},
-	35:  &Tag{ID: 35, Name: "日常話"},
-	36:  &Tag{ID: 36, Name: "趣味の話"},
-	37:  &Tag{ID: 37, Name: "語学学習"},
-	38:  &Tag{ID: 38, Name: "お料理配信"},
-	39:  &Tag{ID: 39, Name: "手料理"},
-	40:  &Tag{ID: 40, Name: "レシピ紹介"},
-	41:  &Tag{ID: 41, Name: "アート配信"},
-	42:  &Tag{ID: 42, Name: "絵描き"},
-	43:  &Tag{ID: 43, Name: "DIY"},
-	44:  &Tag{ID: 44, Name: "手芸"},
-	45:  &Tag{ID: 45, Name: "アニメトーク"},
-	46:  &Tag{ID: 46, Name: "映画レビュー"},
-	47:  &Tag{ID: 47, Name: "読書感想"},
-	48:  &Tag{ID: 48, Name: "ファッション"},
-	49:  &Tag{ID: 49, Name: "メイク"},
-	50:  &Tag{ID: 50, Name: "ビューティー"},
-	51:  &Tag{ID: 51, Name: "健康"},
-	52:  &Tag{ID: 52, Name: "ワークアウト"},
-	53:  &Tag{ID: 53, Name: "ヨガ"},
-	54:  &Tag{ID: 54, Name: "ダンス"},
-	55:  &Tag{ID: 55, Name: "旅行記"},
-	56:  &Tag{ID: 56, Name: "アウトドア"},
-	57:  &Tag{ID: 57, Name: "キャンプ"},
-	58:  &Tag{ID: 58, Name: "ペットと一緒"},
-	59:  &Tag{ID: 59, Name: "猫"},
-	60:  &Tag{ID: 60, Name: "犬"},
-	61:  &Tag{ID: 61, Name: "釣り"},
-	62:  &Tag{ID: 62, Name: "ガーデニング"},
-	63:  &Tag{ID: 63, Name: "テクノロジー"},
-	64:  &Tag{ID: 64, Name: "ガジェット紹介"},
-	65:  &Tag{ID: 65, Name: "プログラミング"},
-	66:  &Tag{ID: 66, Name: "DIY電子工作"},
-	67:  &Tag{ID: 67, Name: "ニュース解説"},
-	68:  &Tag{ID: 68, Name: "歴史"},
-	69:  &Tag{ID: 69, Name: "文化"},
-	70:  &Tag{ID: 70, Name: "社会問題"},
-	71:  &Tag{ID: 71, Name: "心理学"},
-	72:  &Tag{ID: 72, Name: "宇宙"},
-	73:  &Tag{ID: 73, Name: "科学"},
-	74:  &Tag{ID: 74, Name: "マジック"},
-	75:  &Tag{ID: 75, Name: "コメディ"},
-	76:  &Tag{ID: 76, Name: "スポーツ"},
-	77:  &Tag{ID: 77, Name: "サッカー"},
-	78:  &Tag{ID: 78, Name: "野球"},
-	79:  &Tag{ID: 79, Name: "バスケットボール"},
-	80:  &Tag{ID: 80, Name: "ライフハック"},
-	81:  &Tag{ID: 81, Name: "教育"},
-	82:  &Tag{ID: 82, Name: "子育て"},
-	83:  &Tag{ID: 83, Name: "ビジネス"},
-	84:  &Tag{ID: 84, Name: "起業"},
-	85:  &Tag{ID: 85, Name: "投資"},
-	86:  &Tag{ID: 86, Name: "仮想通貨"},
-	87:  &Tag{ID: 87, Name: "株式投資"},
-	88:  &Tag{ID: 88, Name: "不動産"},
-	89:  &Tag{ID: 89, Name: "キャリア"},
-	90:  &Tag{ID: 90, Name: "スピリチュアル"},
-	91:  &Tag{ID: 91, Name: "占い"},
-	92:  &Tag{ID: 92, Name: "手相"},
-	93:  &Tag{ID: 93, Name: "オカルト"},
-	94:  &Tag{ID: 94, Name: "UFO"},
-	95:  &Tag{ID: 95, Name: "都市伝説"},
-	96:  &Tag{ID: 96, Name: "コンサート"},
-	97:  &Tag{ID: 97, Name: "ファンミーティング"},
-	98:  &Tag{ID: 98, Name: "コラボ配信"},
-	99:  &Tag{ID: 99, Name: "記念配信"},
-	100: &Tag{ID: 100, Name: "生誕祭"},
-	101: &Tag{ID: 101, Name: "周年記念"},
-	102: &Tag{ID: 102, Name: "サプライズ"},
-	103: &Tag{ID: 103, Name: "椅子"},
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 1配信あたりのタグの上限
+	maxLivestreamTags = 10
+
+	tagCacheReloadIntervalSecondsEnvKey = "ISUCON13_TAG_CACHE_RELOAD_INTERVAL_SECONDS"
+)
+
+// 他のホストでのタグの変更を取り込むため、キャッシュを読み直す間隔
+var tagCacheReloadInterval = 10 * time.Second
+
+func loadTagCacheReloadInterval() (time.Duration, error) {
+	v, ok := os.LookupEnv(tagCacheReloadIntervalSecondsEnvKey)
+	if !ok {
+		return tagCacheReloadInterval, nil
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("environment variable '%s' must be positive integer", tagCacheReloadIntervalSecondsEnvKey)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// tagsテーブルのキャッシュ
+// 起動時・初期化時とタグの変更時、tagCacheReloadIntervalごとにLoadで読み直す
+// キャッシュはホストごとなので、古いことがある (整合性が必要な確認はDBを見る)
+type TagCache struct {
+	mu      sync.RWMutex
+	byID    map[int64]Tag
+	retired map[int64]bool
+	// 引退していないタグの一覧 (GET /api/tag のレスポンス)
+	response *TagsResponse
+}
+
+var tagCache = &TagCache{
+	byID:     map[int64]Tag{},
+	retired:  map[int64]bool{},
+	response: &TagsResponse{Tags: []*Tag{}},
+}
+
+func (tc *TagCache) Load(ctx context.Context, db sqlx.QueryerContext) error {
+	var tagModels []*TagModel
+	if err := sqlx.SelectContext(ctx, db, &tagModels, "SELECT * FROM tags ORDER BY id"); err != nil {
+		return fmt.Errorf("failed to get tags: %w", err)
+	}
+
+	byID := make(map[int64]Tag, len(tagModels))
+	retired := make(map[int64]bool)
+	activeTags := make([]*Tag, 0, len(tagModels))
+	for _, tagModel := range tagModels {
+		tag := Tag{ID: tagModel.ID, Name: tagModel.Name}
+		byID[tag.ID] = tag
+		if tagModel.Retired {
+			retired[tag.ID] = true
+			continue
+		}
+		activeTags = append(activeTags, &tag)
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.byID = byID
+	tc.retired = retired
+	tc.response = &TagsResponse{Tags: activeTags}
+	return nil
+}
+
+// 引退したタグも含めて引く
+func (tc *TagCache) Get(id int64) (Tag, bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	tag, ok := tc.byID[id]
+	return tag, ok
+}
+
+func (tc *TagCache) IsRetired(id int64) bool {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.retired[id]
+}
+
+func (tc *TagCache) Response() *TagsResponse {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.response
+}
+
+// 配信に付与するタグの重複を除いて返す
+// タグが存在して引退していないかは、トランザクション内でlockTagsで確認する
+func validateTagIDs(tagIDs []int64) ([]int64, error) {
+	seen := make(map[int64]struct{}, len(tagIDs))
+	ids := make([]int64, 0, len(tagIDs))
+	for _, id := range tagIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	if len(ids) > maxLivestreamTags {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("a livestream can have at most %d tags", maxLivestreamTags))
+	}
+	return ids, nil
+}
+
+// 配信に付与するタグが存在して引退していないことを確認し、コミットまで変更されないようロックする
+// 他のホストで変更されたばかりのことがあるので、キャッシュではなくtagsテーブルを見る
+func lockTags(ctx context.Context, tx *sqlx.Tx, tagIDs []int64) error {
+	if len(tagIDs) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM tags WHERE id IN (?) FOR SHARE", tagIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query for tags: "+err.Error())
+	}
+	var tagModels []*TagModel
+	if err := tx.SelectContext(ctx, &tagModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+
+	tagModelByID := make(map[int64]*TagModel, len(tagModels))
+	for _, tagModel := range tagModels {
+		tagModelByID[tagModel.ID] = tagModel
+	}
+	for _, id := range tagIDs {
+		tagModel, ok := tagModelByID[id]
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tag %d is not found", id))
+		}
+		if tagModel.Retired {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tag %d is retired", id))
+		}
+	}
+	return nil
+}
+
+func insertLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error {
+	for _, tagID := range tagIDs {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
+			LivestreamID: livestreamID,
+			TagID:        tagID,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagCacheReloadIntervalごとにキャッシュを読み直す
+func startTagCacheReloader(logger echo.Logger) {
+	go func() {
+		ticker := time.NewTicker(tagCacheReloadInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := tagCache.Load(context.Background(), dbConn); err != nil {
+				logger.Errorf("failed to reload tags: %v", err)
+			}
+		}
+	}()
 }
@@ -16,27 +16,16 @@ type Tag struct {
 type TagModel struct {
 	ID   int64  `db:"id"`
 	Name string `db:"name"`
+	// 引退したタグは新しい配信に付与できない
+	Retired bool `db:"retired"`
 }
 
 type TagsResponse struct {
 	Tags []*Tag `json:"tags"`
 }
 
-var tagsResponseCache *TagsResponse
-
 func getTagHandler(c echo.Context) error {
-	if tagsResponseCache != nil {
-		return c.JSON(http.StatusOK, tagsResponseCache)
-	}
-
-	tags := make([]*Tag, len(tagsAll))
-	for id, tag := range tagsAll {
-		tags[id-1] = tag
-	}
-	tagsResponseCache = &TagsResponse{
-		Tags: tags,
-	}
-	return c.JSON(http.StatusOK, tagsResponseCache)
+	return c.JSON(http.StatusOK, tagCache.Response())
 }
 
 // 配信者のテーマ取得API
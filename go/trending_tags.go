@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	trendingTagsWindowSecondsEnvKey  = "ISUCON13_TRENDING_TAGS_WINDOW_SECONDS"
+	trendingTagsRefreshSecondsEnvKey = "ISUCON13_TRENDING_TAGS_REFRESH_SECONDS"
+
+	TrendingTagsSortActivity    = "activity"
+	TrendingTagsSortLivestreams = "livestreams"
+
+	defaultTrendingTagsLimit = 10
+	maxTrendingTagsLimit     = 100
+)
+
+// 人気のタグの集計設定
+type TrendingTagsConfig struct {
+	// リアクション・チップを集計する期間
+	Window time.Duration
+	// 集計し直す間隔
+	RefreshInterval time.Duration
+}
+
+var trendingTagsConfig = TrendingTagsConfig{
+	Window:          24 * time.Hour,
+	RefreshInterval: time.Minute,
+}
+
+func loadTrendingTagsConfig() (TrendingTagsConfig, error) {
+	conf := trendingTagsConfig
+
+	if v, ok := os.LookupEnv(trendingTagsWindowSecondsEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return TrendingTagsConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", trendingTagsWindowSecondsEnvKey)
+		}
+		conf.Window = time.Duration(seconds) * time.Second
+	}
+	if v, ok := os.LookupEnv(trendingTagsRefreshSecondsEnvKey); ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			return TrendingTagsConfig{}, fmt.Errorf("environment variable '%s' must be positive integer", trendingTagsRefreshSecondsEnvKey)
+		}
+		conf.RefreshInterval = time.Duration(seconds) * time.Second
+	}
+
+	return conf, nil
+}
+
+type TrendingTag struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// 予約中・配信中の配信数
+	Livestreams int64 `json:"livestreams"`
+	// 集計期間内のリアクション数
+	Reactions int64 `json:"reactions"`
+	// 集計期間内のチップ合計
+	Tips int64 `json:"tips"`
+	// リアクション数とチップ合計の和
+	Score int64 `json:"score"`
+}
+
+type TrendingTagsResponse struct {
+	Tags []TrendingTag `json:"tags"`
+	// 集計した時刻
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+type tagCount struct {
+	TagID int64 `db:"tag_id"`
+	Count int64 `db:"count"`
+}
+
+// 人気のタグの集計結果のキャッシュ
+type TrendingTagsCache struct {
+	mu        sync.RWMutex
+	tags      []TrendingTag
+	updatedAt int64
+}
+
+var trendingTagsCache = &TrendingTagsCache{}
+
+func (tc *TrendingTagsCache) Refresh(ctx context.Context, db sqlx.QueryerContext) error {
+	now := time.Now()
+	since := now.Add(-trendingTagsConfig.Window).Unix()
+
+	var livestreamCounts []tagCount
+	if err := sqlx.SelectContext(ctx, db, &livestreamCounts, "SELECT lt.tag_id, COUNT(*) AS count FROM livestream_tags lt INNER JOIN livestreams l ON l.id = lt.livestream_id WHERE l.end_at > ? GROUP BY lt.tag_id", now.Unix()); err != nil {
+		return fmt.Errorf("failed to count livestreams by tag: %w", err)
+	}
+	var reactionCounts []tagCount
+	if err := sqlx.SelectContext(ctx, db, &reactionCounts, "SELECT lt.tag_id, COUNT(*) AS count FROM reactions r INNER JOIN livestream_tags lt ON lt.livestream_id = r.livestream_id WHERE r.created_at >= ? GROUP BY lt.tag_id", since); err != nil {
+		return fmt.Errorf("failed to count reactions by tag: %w", err)
+	}
+	var tipSums []tagCount
+	if err := sqlx.SelectContext(ctx, db, &tipSums, "SELECT lt.tag_id, IFNULL(SUM(lc.tip), 0) AS count FROM livecomments lc INNER JOIN livestream_tags lt ON lt.livestream_id = lc.livestream_id WHERE lc.created_at >= ? AND lc.tip > 0 GROUP BY lt.tag_id", since); err != nil {
+		return fmt.Errorf("failed to sum tips by tag: %w", err)
+	}
+
+	statsByTagID := make(map[int64]*TrendingTag)
+	stats := func(tagID int64) *TrendingTag {
+		if s, ok := statsByTagID[tagID]; ok {
+			return s
+		}
+		s := &TrendingTag{ID: tagID}
+		statsByTagID[tagID] = s
+		return s
+	}
+	for _, c := range livestreamCounts {
+		stats(c.TagID).Livestreams = c.Count
+	}
+	for _, c := range reactionCounts {
+		stats(c.TagID).Reactions = c.Count
+	}
+	for _, c := range tipSums {
+		stats(c.TagID).Tips = c.Count
+	}
+
+	tags := make([]TrendingTag, 0, len(statsByTagID))
+	for _, s := range statsByTagID {
+		s.Score = s.Reactions + s.Tips
+		tags = append(tags, *s)
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.tags = tags
+	tc.updatedAt = now.Unix()
+	return nil
+}
+
+// 指定された順に並べた上位limit件を返す
+func (tc *TrendingTagsCache) Ranking(sortBy string, limit int) *TrendingTagsResponse {
+	tc.mu.RLock()
+	tags := make([]TrendingTag, 0, len(tc.tags))
+	for _, t := range tc.tags {
+		// 集計後に名前の変更・統合・引退があっても反映されるよう、タグ名はここで引く
+		tag, ok := tagCache.Get(t.ID)
+		if !ok || tagCache.IsRetired(t.ID) {
+			continue
+		}
+		t.Name = tag.Name
+		tags = append(tags, t)
+	}
+	updatedAt := tc.updatedAt
+	tc.mu.RUnlock()
+
+	sort.Slice(tags, func(i, j int) bool {
+		a, b := tags[i], tags[j]
+		if sortBy == TrendingTagsSortLivestreams && a.Livestreams != b.Livestreams {
+			return a.Livestreams > b.Livestreams
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Livestreams != b.Livestreams {
+			return a.Livestreams > b.Livestreams
+		}
+		return a.ID < b.ID
+	})
+	if len(tags) > limit {
+		tags = tags[:limit]
+	}
+
+	return &TrendingTagsResponse{Tags: tags, UpdatedAt: updatedAt}
+}
+
+// RefreshIntervalごとに集計し直す
+func startTrendingTagsRefresher(logger echo.Logger) {
+	go func() {
+		ticker := time.NewTicker(trendingTagsConfig.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			if err := trendingTagsCache.Refresh(context.Background(), dbConn); err != nil {
+				logger.Errorf("failed to refresh trending tags: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// 人気のタグ一覧
+// GET /api/tag/trending
+func getTrendingTagsHandler(c echo.Context) error {
+	sortBy := c.QueryParam("sort")
+	if sortBy == "" {
+		sortBy = TrendingTagsSortActivity
+	}
+	if sortBy != TrendingTagsSortActivity && sortBy != TrendingTagsSortLivestreams {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("sort must be %s or %s", TrendingTagsSortActivity, TrendingTagsSortLivestreams))
+	}
+
+	limit := defaultTrendingTagsLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxTrendingTagsLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit query parameter must be between 1 and %d", maxTrendingTagsLimit))
+		}
+		limit = l
+	}
+
+	return c.JSON(http.StatusOK, trendingTagsCache.Ranking(sortBy, limit))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 退会したユーザの表示名
+const deletedUserDisplayName = "退会したユーザ"
+
+// 退会したユーザの名前
+// _ はサブドメインに使えない文字なので、登録されるユーザ名とは衝突しない
+func deletedUserName(userID int64) string {
+	return fmt.Sprintf("_deleted_%d", userID)
+}
+
+// 退会
+// 他のユーザのデータから参照されるため、ユーザ自体は削除せずに匿名化する
+//   - 開始前の配信は予約枠を返却して削除する (配信中・終了済みの配信は残す)
+//   - 投稿したライブコメント・リアクションは匿名化したユーザのものとして残す
+//   - アイコン・セッション・フォロー・Webhook・通知・コラボレーター・視聴履歴は削除する
+//   - <name>.u.isucon.dev のレコードを削除する
+//
+// DELETE /api/user/me
+func deleteMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? AND deleted_at IS NULL FOR UPDATE", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	now := time.Now()
+
+	if err := deleteFutureLivestreams(ctx, tx, userID, now.Unix()); err != nil {
+		return err
+	}
+
+	if err := deleteUserData(ctx, tx, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user data: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET name = ?, display_name = ?, description = '', password = '', deleted_at = ? WHERE id = ?", deletedUserName(userID), deletedUserDisplayName, now.Unix(), userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to anonymize user: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE themes SET dark_mode = FALSE WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset user theme: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	invalidateIconCache(userID)
+
+	// 退会自体は済んでいるので、失敗してもエラーにはしない
+	if err := dnsProvider.DeleteRecord(ctx, userModel.Name); err != nil {
+		c.Logger().Errorf("failed to delete dns record for %s: %v", userModel.Name, err)
+	}
+
+	sess.Options.MaxAge = -1
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 開始前の配信を予約枠を返却して削除する
+func deleteFutureLivestreams(ctx context.Context, tx *sqlx.Tx, userID int64, now int64) error {
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? AND start_at > ? FOR UPDATE", userID, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	if len(livestreamModels) == 0 {
+		return nil
+	}
+
+	ranges := make([]ReservationRange, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		ranges[i] = ReservationRange{StartAt: livestreamModel.StartAt, EndAt: livestreamModel.EndAt}
+	}
+	if _, err := lockReservationSlots(ctx, tx, ranges...); err != nil {
+		return err
+	}
+
+	for _, livestreamModel := range livestreamModels {
+		if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return err
+		}
+		if err := deleteLivestream(ctx, tx, livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream: "+err.Error())
+		}
+	}
+	return nil
+}
+
+// 退会したユーザ本人にしか意味のないデータを削除する
+func deleteUserData(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	queries := []string{
+		"DELETE FROM icons WHERE user_id = ?",
+		"DELETE FROM user_sessions WHERE user_id = ?",
+		"DELETE FROM follows WHERE follower_id = ?",
+		"DELETE FROM follows WHERE followee_id = ?",
+		"DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE user_id = ?)",
+		"DELETE FROM webhooks WHERE user_id = ?",
+		"DELETE FROM notifications WHERE user_id = ?",
+		"DELETE FROM livestream_collaborators WHERE user_id = ?",
+		"DELETE FROM livestream_viewers_history WHERE user_id = ?",
+		"DELETE FROM streamer_viewers WHERE user_id = ?",
+		"DELETE FROM streamer_viewers WHERE streamer_id = ?",
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -8,11 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os/exec"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -24,7 +24,12 @@ const (
 	defaultSessionExpiresKey = "EXPIRES"
 	defaultUserIDKey         = "USERID"
 	defaultUsernameKey       = "USERNAME"
-	bcryptDefaultCost        = bcrypt.MinCost
+	bcryptDefaultCost        = bcrypt.DefaultCost
+
+	// users.display_name は VARCHAR(255)
+	maxDisplayNameLength = 255
+	// users.description は TEXT
+	maxDescriptionBytes = 65535
 )
 
 var fallbackImage = "../img/NoImage.jpg"
@@ -35,6 +40,8 @@ type UserModel struct {
 	DisplayName    string `db:"display_name"`
 	Description    string `db:"description"`
 	HashedPassword string `db:"password"`
+	// 退会した日時 (退会していなければNULL)
+	DeletedAt *int64 `db:"deleted_at"`
 }
 
 type User struct {
@@ -44,6 +51,10 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// フォローされている数
+	FollowerCount int64 `json:"follower_count"`
+	// フォローしている数
+	FollowingCount int64 `json:"following_count"`
 }
 
 type Theme struct {
@@ -70,6 +81,17 @@ type PostUserRequestTheme struct {
 	DarkMode bool `json:"dark_mode"`
 }
 
+// 省略したフィールドは変更しない
+type PatchUserRequest struct {
+	DisplayName *string                `json:"display_name"`
+	Description *string                `json:"description"`
+	Theme       *PatchUserRequestTheme `json:"theme"`
+}
+
+type PatchUserRequestTheme struct {
+	DarkMode *bool `json:"dark_mode"`
+}
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	// Password is non-hashed password.
@@ -167,6 +189,7 @@ func postIconHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	invalidateIconCache(userID)
 
 	return c.JSON(http.StatusCreated, &PostIconResponse{
 		ID: iconID,
@@ -213,6 +236,92 @@ func getMeHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+func validatePatchUserRequest(req *PatchUserRequest) error {
+	if req.DisplayName == nil && req.Description == nil && (req.Theme == nil || req.Theme.DarkMode == nil) {
+		return echo.NewHTTPError(http.StatusBadRequest, "no fields to update")
+	}
+	if req.DisplayName != nil {
+		if strings.TrimSpace(*req.DisplayName) == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "display_name must not be empty")
+		}
+		if utf8.RuneCountInString(*req.DisplayName) > maxDisplayNameLength {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("display_name must be at most %d characters", maxDisplayNameLength))
+		}
+	}
+	if req.Description != nil && len(*req.Description) > maxDescriptionBytes {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("description must be at most %d bytes", maxDescriptionBytes))
+	}
+	return nil
+}
+
+// プロフィールの変更
+// PATCH /api/user/me
+func patchMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PatchUserRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := validatePatchUserRequest(req); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if req.DisplayName != nil {
+		userModel.DisplayName = *req.DisplayName
+	}
+	if req.Description != nil {
+		userModel.Description = *req.Description
+	}
+	if _, err := tx.NamedExecContext(ctx, "UPDATE users SET display_name = :display_name, description = :description WHERE id = :id", userModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user: "+err.Error())
+	}
+
+	if req.Theme != nil && req.Theme.DarkMode != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE themes SET dark_mode = ? WHERE user_id = ?", *req.Theme.DarkMode, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user theme: "+err.Error())
+		}
+	}
+
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	invalidateIconCache(userID)
+
+	return c.JSON(http.StatusOK, user)
+}
+
 // ユーザ登録API
 // POST /api/register
 func registerHandler(c echo.Context) error {
@@ -224,11 +333,14 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	if req.Name == "pipe" {
-		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
+	if err := validateUsername(req.Name); err != nil {
+		return err
+	}
+	if len(req.Password) > maxPasswordBytes {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("password must be at most %d bytes", maxPasswordBytes))
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
 	}
@@ -243,10 +355,17 @@ func registerHandler(c echo.Context) error {
 		Name:           req.Name,
 		DisplayName:    req.DisplayName,
 		Description:    req.Description,
-		HashedPassword: string(hashedPassword),
+		HashedPassword: hashedPassword,
+	}
+
+	if err := ensureUsernameAvailable(ctx, tx, req.Name); err != nil {
+		return err
 	}
 
 	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
+	if isDuplicateEntry(err) {
+		return usernameTakenError(req.Name)
+	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
 	}
@@ -266,10 +385,6 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
 	}
 
-	if out, err := exec.Command("pdnsutil", "add-record", "u.isucon.dev", req.Name, "A", "0", powerDNSSubdomainAddress).CombinedOutput(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
-	}
-
 	user, err := fillUserResponse(ctx, tx, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
@@ -279,6 +394,12 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// DNSレコードはコミットできたユーザについてのみ作る
+	// ユーザ登録自体は済んでいるので、失敗してもエラーにはしない
+	if err := dnsProvider.AddRecord(ctx, req.Name, powerDNSSubdomainAddress); err != nil {
+		c.Logger().Errorf("failed to add dns record for %s: %v", req.Name, err)
+	}
+
 	return c.JSON(http.StatusCreated, user)
 }
 
@@ -301,7 +422,8 @@ func loginHandler(c echo.Context) error {
 
 	userModel := UserModel{}
 	// usernameはUNIQUEなので、whereで一意に特定できる
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", req.Username)
+	// 退会したユーザはログインできない
+	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ? AND deleted_at IS NULL", req.Username)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
 	}
@@ -309,10 +431,6 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
 	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
 	if err == bcrypt.ErrMismatchedHashAndPassword {
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
@@ -321,24 +439,46 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	// 設定より低いコストのハッシュは、平文が手元にあるログイン時に作り直す
+	if needsRehash(userModel.HashedPassword) {
+		hashedPassword, err := hashPassword(req.Password)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", hashedPassword, userModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update password: "+err.Error())
+		}
+	}
+
+	now := time.Now()
+	sessionEndAt := sessionConfig.InitialExpiresAt(now)
 
 	sessionID := uuid.NewString()
 
+	if err := createUserSession(ctx, tx, &UserSessionModel{
+		ID:        sessionID,
+		UserID:    userModel.ID,
+		UserAgent: c.Request().UserAgent(),
+		CreatedAt: now.Unix(),
+		ExpiresAt: sessionEndAt,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create session: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	sess.Options = &sessions.Options{
-		Domain: "u.isucon.dev",
-		MaxAge: int(60000),
-		Path:   "/",
-	}
+	sess.Options = sessionConfig.CookieOptions(now, sessionEndAt)
 	sess.Values[defaultSessionIDKey] = sessionID
 	sess.Values[defaultUserIDKey] = userModel.ID
 	sess.Values[defaultUsernameKey] = userModel.Name
-	sess.Values[defaultSessionExpiresKey] = sessionEndAt.Unix()
+	sess.Values[defaultSessionExpiresKey] = sessionEndAt
 
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
@@ -395,17 +535,29 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
 	}
 
-	_, ok = sess.Values[defaultUserIDKey].(int64)
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
 	if !ok {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
 	}
 
+	sessionID, ok := sess.Values[defaultSessionIDKey].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get SESSIONID value from session")
+	}
+
 	now := time.Now()
 	if now.Unix() > sessionExpires.(int64) {
 		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
 	}
 
-	return nil
+	// ログアウト済みのセッションを弾く
+	userSessionModel, err := verifyServerSession(c.Request().Context(), sessionID, userID, now)
+	if err != nil {
+		return err
+	}
+
+	// 操作が続いている間はログインしたままにする
+	return renewUserSession(c, sess, userSessionModel, now)
 }
 
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
@@ -434,5 +586,12 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 		IconHash: iconHash,
 	}
 
+	followerCounts, followingCounts, err := bulkGetFollowCounts(ctx, tx, []int64{userModel.ID})
+	if err != nil {
+		return User{}, err
+	}
+	user.FollowerCount = followerCounts[userModel.ID]
+	user.FollowingCount = followingCounts[userModel.ID]
+
 	return user, nil
 }
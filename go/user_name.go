@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	reservedUsernamesEnvKey = "ISUCON13_RESERVED_USERNAMES"
+
+	// ユーザ名が使えない理由 (ErrorResponse.Reason)
+	// ユーザ名は<name>.u.isucon.devのラベルになるので、DNSラベルとして使えない理由も兼ねる
+	UsernameReasonEmpty            = "username_empty"
+	UsernameReasonTooLong          = "username_too_long"
+	UsernameReasonInvalidCharacter = "username_invalid_character"
+	UsernameReasonInvalidHyphen    = "username_invalid_hyphen"
+	UsernameReasonReserved         = "username_reserved"
+	UsernameReasonTaken            = "username_taken"
+
+	mysqlErrDuplicateEntry = 1062
+)
+
+var usernameReasonMessages = map[string]string{
+	UsernameReasonEmpty:            "username must not be empty",
+	UsernameReasonTooLong:          fmt.Sprintf("username must be at most %d characters", maxDNSLabelLength),
+	UsernameReasonInvalidCharacter: "username must consist of alphanumeric characters and hyphens",
+	UsernameReasonInvalidHyphen:    "username must not start or end with a hyphen",
+}
+
+// ゾーンファイル以外で予約しておくユーザ名
+var defaultReservedUsernames = []string{"pipe"}
+
+// 登録できないユーザ名 (小文字)
+var reservedUsernames = map[string]bool{}
+
+// ゾーンファイルに書かれた名前と、デフォルト・環境変数で指定した名前を予約する
+// 環境変数はカンマ区切り
+func loadReservedUsernames(zone *StaticZone) map[string]bool {
+	names := make(map[string]bool)
+	for _, record := range zone.Records {
+		if record.Name != "@" {
+			names[record.Name] = true
+		}
+	}
+	for _, name := range defaultReservedUsernames {
+		names[name] = true
+	}
+	if v, ok := os.LookupEnv(reservedUsernamesEnvKey); ok {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names[strings.ToLower(name)] = true
+			}
+		}
+	}
+	return names
+}
+
+// 機械的に判別できる理由付きのエラー
+// errorResponseHandlerがReasonをレスポンスに含める
+type ReasonError struct {
+	Reason string
+}
+
+func (e *ReasonError) Error() string {
+	return e.Reason
+}
+
+func newReasonHTTPError(code int, reason string, message string) *echo.HTTPError {
+	return echo.NewHTTPError(code, message).SetInternal(&ReasonError{Reason: reason})
+}
+
+// ユーザ名がDNSラベルとして使えて、予約されていないか確認する
+func validateUsername(name string) error {
+	if reason := dnsLabelViolation(name); reason != "" {
+		return newReasonHTTPError(http.StatusBadRequest, reason, usernameReasonMessages[reason])
+	}
+	if reservedUsernames[strings.ToLower(name)] {
+		return newReasonHTTPError(http.StatusBadRequest, UsernameReasonReserved, fmt.Sprintf("the username '%s' is reserved", name))
+	}
+	return nil
+}
+
+// 大文字・小文字を区別せずに、同じ名前のユーザがいないか確認する
+// (DNSでは区別されないため)
+func ensureUsernameAvailable(ctx context.Context, tx *sqlx.Tx, name string) error {
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM users WHERE LOWER(name) = LOWER(?)", name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	if count > 0 {
+		return usernameTakenError(name)
+	}
+	return nil
+}
+
+func usernameTakenError(name string) error {
+	return newReasonHTTPError(http.StatusBadRequest, UsernameReasonTaken, fmt.Sprintf("the username '%s' is already taken", name))
+}
+
+// 同時に登録された場合は、一意制約違反になる
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry
+}
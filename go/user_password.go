@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	bcryptCostEnvKey = "ISUCON13_BCRYPT_COST"
+
+	// bcryptは72バイトを超えるパスワードを扱えない
+	maxPasswordBytes = 72
+)
+
+// パスワードのハッシュ化に使うコスト
+// これより低いコストのハッシュはログイン時に作り直す
+var bcryptCost = bcryptDefaultCost
+
+func loadBcryptCost() (int, error) {
+	v, ok := os.LookupEnv(bcryptCostEnvKey)
+	if !ok {
+		return bcryptCost, nil
+	}
+	cost, err := strconv.Atoi(v)
+	if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return 0, fmt.Errorf("environment variable '%s' must be integer between %d and %d", bcryptCostEnvKey, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return cost, nil
+}
+
+func hashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
+// 設定より低いコストでハッシュ化されているか
+func needsRehash(hashedPassword string) bool {
+	cost, err := bcrypt.Cost([]byte(hashedPassword))
+	if err != nil {
+		return false
+	}
+	return cost < bcryptCost
+}
+
+type PostPasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// パスワードの変更
+// このセッション以外のセッションは失効させる
+// POST /api/user/me/password
+func postPasswordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	var req *PostPasswordRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.NewPassword == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "new_password must not be empty")
+	}
+	if len(req.NewPassword) > maxPasswordBytes {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("new_password must be at most %d bytes", maxPasswordBytes))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.CurrentPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return echo.NewHTTPError(http.StatusForbidden, "current password is incorrect")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
+	}
+
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", hashedPassword, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update password: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE user_sessions SET revoked_at = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL", time.Now().Unix(), userID, sessionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
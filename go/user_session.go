@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ログイン中のセッション
+// クッキーに入っているSESSIONIDで引き、revoked_atが入っていれば無効とする
+type UserSessionModel struct {
+	ID        string `db:"id"`
+	UserID    int64  `db:"user_id"`
+	UserAgent string `db:"user_agent"`
+	CreatedAt int64  `db:"created_at"`
+	ExpiresAt int64  `db:"expires_at"`
+	RevokedAt *int64 `db:"revoked_at"`
+}
+
+type UserSession struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"user_agent"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+	// このリクエストのセッションかどうか
+	Current bool `json:"current"`
+}
+
+// user_sessions.user_agent の長さ
+const maxUserAgentLength = 1024
+
+func createUserSession(ctx context.Context, tx *sqlx.Tx, userSessionModel *UserSessionModel) error {
+	if len(userSessionModel.UserAgent) > maxUserAgentLength {
+		userSessionModel.UserAgent = userSessionModel.UserAgent[:maxUserAgentLength]
+	}
+	// 期限切れのセッションはログインのついでに掃除する
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_sessions WHERE user_id = ? AND expires_at < ?", userSessionModel.UserID, userSessionModel.CreatedAt); err != nil {
+		return err
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO user_sessions (id, user_id, user_agent, created_at, expires_at) VALUES (:id, :user_id, :user_agent, :created_at, :expires_at)", userSessionModel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// セッションが失効していないか確認する
+func verifyServerSession(ctx context.Context, sessionID string, userID int64, now time.Time) (UserSessionModel, error) {
+	var userSessionModel UserSessionModel
+	if err := dbConn.GetContext(ctx, &userSessionModel, "SELECT * FROM user_sessions WHERE id = ?", sessionID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserSessionModel{}, echo.NewHTTPError(http.StatusUnauthorized, "session has been revoked")
+		}
+		return UserSessionModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get session: "+err.Error())
+	}
+	if userSessionModel.UserID != userID || userSessionModel.RevokedAt != nil {
+		return UserSessionModel{}, echo.NewHTTPError(http.StatusUnauthorized, "session has been revoked")
+	}
+	if now.Unix() > userSessionModel.ExpiresAt {
+		return UserSessionModel{}, echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
+	}
+	return userSessionModel, nil
+}
+
+// 操作のあったセッションの期限を延長する
+// 失効済みのセッションを延長しないよう、revoked_atも条件に入れる
+func renewUserSession(c echo.Context, sess *sessions.Session, userSessionModel UserSessionModel, now time.Time) error {
+	expiresAt, ok := sessionConfig.RenewedExpiresAt(now, userSessionModel.CreatedAt, userSessionModel.ExpiresAt)
+	if !ok {
+		return nil
+	}
+
+	if _, err := dbConn.ExecContext(c.Request().Context(), "UPDATE user_sessions SET expires_at = ? WHERE id = ? AND revoked_at IS NULL", expiresAt, userSessionModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to renew session: "+err.Error())
+	}
+
+	sess.Options = sessionConfig.CookieOptions(now, expiresAt)
+	sess.Values[defaultSessionExpiresKey] = expiresAt
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+	return nil
+}
+
+// ログアウト (このセッションを失効させる)
+// POST /api/logout
+func logoutHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE user_sessions SET revoked_at = ? WHERE id = ? AND user_id = ?", time.Now().Unix(), sessionID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke session: "+err.Error())
+	}
+
+	// クッキーも削除する
+	sess.Options.MaxAge = -1
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ログイン中のセッション一覧
+// GET /api/user/me/sessions
+func getUserSessionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	var userSessionModels []UserSessionModel
+	if err := dbConn.SelectContext(ctx, &userSessionModels, "SELECT * FROM user_sessions WHERE user_id = ? AND revoked_at IS NULL AND expires_at >= ? ORDER BY created_at DESC", userID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get sessions: "+err.Error())
+	}
+
+	userSessions := make([]UserSession, len(userSessionModels))
+	for i, m := range userSessionModels {
+		userSessions[i] = UserSession{
+			ID:        m.ID,
+			UserAgent: m.UserAgent,
+			CreatedAt: m.CreatedAt,
+			ExpiresAt: m.ExpiresAt,
+			Current:   m.ID == sessionID,
+		}
+	}
+	return c.JSON(http.StatusOK, userSessions)
+}
+
+// 指定したセッションを失効させる
+// DELETE /api/user/me/sessions/:session_id
+func revokeUserSessionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	rs, err := dbConn.ExecContext(ctx, "UPDATE user_sessions SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL", time.Now().Unix(), c.Param("session_id"), userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke session: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 全ての端末からログアウトする (このセッションも含む)
+// DELETE /api/user/me/sessions
+func revokeAllUserSessionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE user_sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", time.Now().Unix(), userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+	}
+
+	sess.Options.MaxAge = -1
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	WebhookEventLivecommentTip      = "livecomment.tip"
+	WebhookEventReactionCreated     = "reaction.created"
+	WebhookEventLivecommentReported = "livecomment.reported"
+	WebhookEventReservationCreated  = "reservation.created"
+	WebhookEventReservationUpdated  = "reservation.updated"
+	WebhookEventReservationCanceled = "reservation.canceled"
+
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+
+	webhookSignatureHeader = "X-Isupipe-Signature"
+	webhookTimestampHeader = "X-Isupipe-Timestamp"
+	webhookEventHeader     = "X-Isupipe-Event"
+	webhookDeliveryHeader  = "X-Isupipe-Delivery"
+
+	// 1ユーザが登録できるWebhookの上限
+	maxWebhooksPerUser = 10
+	// この回数失敗したら送信を諦める
+	maxWebhookDeliveryAttempts = 6
+	// 再送間隔は webhookRetryBaseInterval * 2^(失敗回数-1) で、webhookRetryMaxIntervalを上限とする
+	webhookRetryBaseInterval = 10 * time.Second
+	webhookRetryMaxInterval  = time.Hour
+	webhookPollInterval      = time.Second
+	webhookBatchSize         = 50
+	webhookTimeout           = 5 * time.Second
+	// 送信中の配送を他のワーカーが拾わないようにする時間
+	// 1回に取り出した配送を全てタイムアウトまで待っても切れないようにする
+	webhookDeliveryLease = webhookBatchSize*webhookTimeout + time.Minute
+	// 配送ログに残すレスポンスボディの長さ
+	maxWebhookResponseBodyLength  = 1024
+	defaultWebhookDeliveriesLimit = 50
+)
+
+var webhookEvents = []string{
+	WebhookEventLivecommentTip,
+	WebhookEventReactionCreated,
+	WebhookEventLivecommentReported,
+	WebhookEventReservationCreated,
+	WebhookEventReservationUpdated,
+	WebhookEventReservationCanceled,
+}
+
+type WebhookModel struct {
+	ID     int64  `db:"id"`
+	UserID int64  `db:"user_id"`
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+	// カンマ区切りのイベント名
+	Events    string `db:"events"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type Webhook struct {
+	ID     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// 作成時のみ返す
+	Secret    string `json:"secret,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type WebhookDeliveryModel struct {
+	ID             int64   `db:"id"`
+	WebhookID      int64   `db:"webhook_id"`
+	Event          string  `db:"event"`
+	Payload        string  `db:"payload"`
+	Status         string  `db:"status"`
+	Attempts       int64   `db:"attempts"`
+	NextAttemptAt  int64   `db:"next_attempt_at"`
+	LastStatusCode *int64  `db:"last_status_code"`
+	LastError      *string `db:"last_error"`
+	CreatedAt      int64   `db:"created_at"`
+	DeliveredAt    *int64  `db:"delivered_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int64   `json:"id"`
+	Event          string  `json:"event"`
+	Status         string  `json:"status"`
+	Attempts       int64   `json:"attempts"`
+	NextAttemptAt  int64   `json:"next_attempt_at"`
+	LastStatusCode *int64  `json:"last_status_code,omitempty"`
+	LastError      *string `json:"last_error,omitempty"`
+	CreatedAt      int64   `json:"created_at"`
+	DeliveredAt    *int64  `json:"delivered_at,omitempty"`
+}
+
+type PostWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// Webhookで送るJSON
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt int64       `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+func (m WebhookModel) subscribes(event string) bool {
+	for _, e := range strings.Split(m.Events, ",") {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// ユーザのWebhookのうち、eventを購読しているものへの配送を登録する
+// 呼び出し元のトランザクションがコミットされたときだけ送信される
+func enqueueWebhookEvent(ctx context.Context, tx *sqlx.Tx, userID int64, event string, data interface{}) error {
+	var webhookModels []WebhookModel
+	if err := tx.SelectContext(ctx, &webhookModels, "SELECT * FROM webhooks WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to get webhooks: %w", err)
+	}
+
+	var payload []byte
+	now := time.Now().Unix()
+	for _, webhookModel := range webhookModels {
+		if !webhookModel.subscribes(event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(&WebhookPayload{Event: event, CreatedAt: now, Data: data})
+			if err != nil {
+				return fmt.Errorf("failed to marshal webhook payload: %w", err)
+			}
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, created_at) VALUES (:webhook_id, :event, :payload, :status, :attempts, :next_attempt_at, :created_at)", &WebhookDeliveryModel{
+			WebhookID:     webhookModel.ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        WebhookDeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}); err != nil {
+			return fmt.Errorf("failed to insert webhook delivery: %w", err)
+		}
+	}
+	return nil
+}
+
+// 受信側は HMAC-SHA256(secret, "<timestamp>.<body>") を検証する
+func signWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookRetryInterval(attempts int64) time.Duration {
+	interval := webhookRetryBaseInterval
+	for i := int64(1); i < attempts && interval < webhookRetryMaxInterval; i++ {
+		interval *= 2
+	}
+	return min(interval, webhookRetryMaxInterval)
+}
+
+// webhook_deliveriesを定期的に見て送信する
+type WebhookDispatcher struct {
+	db     *sqlx.DB
+	client *http.Client
+	logger echo.Logger
+}
+
+// 内部ネットワークへのリクエストに使われないよう、公開アドレス以外には接続しない
+// 名前解決の結果が登録時と変わっていることがあるので、接続するアドレスを検査する
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if addr, err := netip.ParseAddr(host); err != nil || !isPublicIP(addr) {
+				return fmt.Errorf("webhook destination %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			// プロキシ経由だと接続先を検査できない
+			Proxy:       nil,
+			DialContext: dialer.DialContext,
+		},
+		// リダイレクト先は検査していないので追わない (3xxは失敗として記録される)
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Webhookの送信先にできないアドレス (IANAの特殊用途アドレスのうち、インターネット上にないもの)
+var webhookDeniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// IPv4射影アドレス (::ffff:10.0.0.1など) はIPv4アドレスとして検査する
+func isPublicIP(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.Zone() != "" {
+		return false
+	}
+	for _, prefix := range webhookDeniedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// 登録時にも、名前解決したアドレスが全て公開アドレスか確認する
+func validateWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to resolve url host %s", host))
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr) {
+			return echo.NewHTTPError(http.StatusBadRequest, "url must not point to a private, loopback or link-local address")
+		}
+	}
+	return nil
+}
+
+func startWebhookDispatcher(logger echo.Logger) {
+	d := &WebhookDispatcher{
+		db:     dbConn,
+		client: newWebhookClient(),
+		logger: logger,
+	}
+	go func() {
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := d.DispatchPending(context.Background()); err != nil {
+				logger.Errorf("failed to dispatch webhooks: %v", err)
+			}
+		}
+	}()
+}
+
+type webhookDeliveryJob struct {
+	WebhookDeliveryModel
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+	// claimで進めた次の送信時刻 (リースの期限)
+	LeasedUntil int64 `db:"-"`
+}
+
+// 送信時刻を迎えた配送を取り出して送信する
+func (d *WebhookDispatcher) DispatchPending(ctx context.Context) error {
+	jobs, err := d.claim(ctx)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		leased, err := d.stillLeased(ctx, job)
+		if err != nil {
+			return err
+		}
+		if !leased {
+			// リースが切れて、他のワーカーが送信済み・送信中
+			continue
+		}
+		statusCode, deliverErr := d.deliver(ctx, job)
+		if err := d.record(ctx, job, statusCode, deliverErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 複数のワーカーが同じ配送を送らないよう、次の送信時刻をリース分だけ先に進めてから送る
+func (d *WebhookDispatcher) claim(ctx context.Context) ([]webhookDeliveryJob, error) {
+	tx, err := d.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var jobs []webhookDeliveryJob
+	if err := tx.SelectContext(ctx, &jobs, `
+		SELECT d.*, w.url, w.secret
+		FROM webhook_deliveries d
+		INNER JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED`, WebhookDeliveryPending, now.Unix(), webhookBatchSize); err != nil {
+		return nil, fmt.Errorf("failed to get webhook deliveries: %w", err)
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+
+	leasedUntil := now.Add(webhookDeliveryLease).Unix()
+	ids := make([]int64, len(jobs))
+	for i := range jobs {
+		ids[i] = jobs[i].ID
+		jobs[i].LeasedUntil = leasedUntil
+	}
+	query, args, err := sqlx.In("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id IN (?)", leasedUntil, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct IN query for webhook_deliveries: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to lease webhook deliveries: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return jobs, nil
+}
+
+// claimした時点から状態が変わっていないか確認する
+// リースが切れて他のワーカーが取り出すと、次の送信時刻が進むか送信済みになっている
+func (d *WebhookDispatcher) stillLeased(ctx context.Context, job webhookDeliveryJob) (bool, error) {
+	var count int
+	if err := d.db.GetContext(ctx, &count, "SELECT COUNT(*) FROM webhook_deliveries WHERE id = ? AND status = ? AND attempts = ? AND next_attempt_at = ?", job.ID, WebhookDeliveryPending, job.Attempts, job.LeasedUntil); err != nil {
+		return false, fmt.Errorf("failed to get webhook delivery: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (d *WebhookDispatcher) deliver(ctx context.Context, job webhookDeliveryJob) (int, error) {
+	body := []byte(job.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(webhookEventHeader, job.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(job.ID, 10))
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(job.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseBodyLength))
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, respBody)
+	}
+	return resp.StatusCode, nil
+}
+
+// 他のワーカーが先に結果を書いていたら上書きしない
+func (d *WebhookDispatcher) record(ctx context.Context, job webhookDeliveryJob, statusCode int, deliverErr error) error {
+	now := time.Now()
+	attempts := job.Attempts + 1
+
+	var code *int64
+	if statusCode != 0 {
+		c := int64(statusCode)
+		code = &c
+	}
+
+	if deliverErr == nil {
+		if _, err := d.db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status_code = ?, last_error = NULL, delivered_at = ? WHERE id = ? AND status = ? AND attempts = ?", WebhookDeliverySucceeded, attempts, code, now.Unix(), job.ID, WebhookDeliveryPending, job.Attempts); err != nil {
+			return fmt.Errorf("failed to update webhook delivery: %w", err)
+		}
+		return nil
+	}
+
+	d.logger.Warnf("webhook delivery %d to %s failed (attempt %d): %v", job.ID, job.URL, attempts, deliverErr)
+	status := WebhookDeliveryPending
+	nextAttemptAt := now.Add(webhookRetryInterval(attempts)).Unix()
+	if attempts >= maxWebhookDeliveryAttempts {
+		status = WebhookDeliveryFailed
+	}
+	if _, err := d.db.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_status_code = ?, last_error = ? WHERE id = ? AND status = ? AND attempts = ?", status, attempts, nextAttemptAt, code, deliverErr.Error(), job.ID, WebhookDeliveryPending, job.Attempts); err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+	return nil
+}
+
+func validateWebhookRequest(ctx context.Context, req *PostWebhookRequest) ([]string, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "url must be an absolute http or https URL")
+	}
+	if err := validateWebhookHost(ctx, u.Hostname()); err != nil {
+		return nil, err
+	}
+
+	if len(req.Events) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "events must not be empty")
+	}
+	seen := map[string]struct{}{}
+	var events []string
+	for _, event := range req.Events {
+		known := false
+		for _, e := range webhookEvents {
+			if e == event {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown event %q", event))
+		}
+		if _, ok := seen[event]; ok {
+			continue
+		}
+		seen[event] = struct{}{}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newWebhookResponse(webhookModel WebhookModel) Webhook {
+	return Webhook{
+		ID:        webhookModel.ID,
+		URL:       webhookModel.URL,
+		Events:    strings.Split(webhookModel.Events, ","),
+		CreatedAt: webhookModel.CreatedAt,
+	}
+}
+
+// Webhookの登録
+// レスポンスに含まれるsecretで署名を検証できる
+// POST /api/webhooks
+func postWebhookHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostWebhookRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	events, err := validateWebhookRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate webhook secret: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM webhooks WHERE user_id = ? FOR UPDATE", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count webhooks: "+err.Error())
+	}
+	if count >= maxWebhooksPerUser {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("a user can register at most %d webhooks", maxWebhooksPerUser))
+	}
+
+	webhookModel := WebhookModel{
+		UserID:    userID,
+		URL:       req.URL,
+		Secret:    secret,
+		Events:    strings.Join(events, ","),
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO webhooks (user_id, url, secret, events, created_at) VALUES (:user_id, :url, :secret, :events, :created_at)", &webhookModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert webhook: "+err.Error())
+	}
+	webhookID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted webhook id: "+err.Error())
+	}
+	webhookModel.ID = webhookID
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	webhook := newWebhookResponse(webhookModel)
+	webhook.Secret = secret
+	return c.JSON(http.StatusCreated, webhook)
+}
+
+// 自分のWebhook一覧
+// GET /api/webhooks
+func getWebhooksHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var webhookModels []WebhookModel
+	if err := dbConn.SelectContext(ctx, &webhookModels, "SELECT * FROM webhooks WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhooks: "+err.Error())
+	}
+
+	webhooks := make([]Webhook, len(webhookModels))
+	for i, webhookModel := range webhookModels {
+		webhooks[i] = newWebhookResponse(webhookModel)
+	}
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+func getOwnWebhook(ctx context.Context, db sqlx.QueryerContext, c echo.Context, userID int64) (WebhookModel, error) {
+	webhookID, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return WebhookModel{}, echo.NewHTTPError(http.StatusBadRequest, "webhook_id in path must be integer")
+	}
+
+	var webhookModel WebhookModel
+	if err := sqlx.GetContext(ctx, db, &webhookModel, "SELECT * FROM webhooks WHERE id = ?", webhookID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WebhookModel{}, echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return WebhookModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhook: "+err.Error())
+	}
+	if webhookModel.UserID != userID {
+		return WebhookModel{}, echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+	}
+	return webhookModel, nil
+}
+
+// Webhookの削除 (配送ログも削除する)
+// DELETE /api/webhooks/:webhook_id
+func deleteWebhookHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	webhookModel, err := getOwnWebhook(ctx, tx, c, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE webhook_id = ?", webhookModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete webhook deliveries: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ?", webhookModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete webhook: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Webhookの配送ログ (新しい順)
+// GET /api/webhooks/:webhook_id/deliveries
+func getWebhookDeliveriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit, err := parseOptionalLimit(c)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		limit = defaultWebhookDeliveriesLimit
+	}
+
+	webhookModel, err := getOwnWebhook(ctx, dbConn, c, userID)
+	if err != nil {
+		return err
+	}
+
+	var deliveryModels []WebhookDeliveryModel
+	if err := dbConn.SelectContext(ctx, &deliveryModels, "SELECT * FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?", webhookModel.ID, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhook deliveries: "+err.Error())
+	}
+
+	deliveries := make([]WebhookDelivery, len(deliveryModels))
+	for i, m := range deliveryModels {
+		deliveries[i] = WebhookDelivery{
+			ID:             m.ID,
+			Event:          m.Event,
+			Status:         m.Status,
+			Attempts:       m.Attempts,
+			NextAttemptAt:  m.NextAttemptAt,
+			LastStatusCode: m.LastStatusCode,
+			LastError:      m.LastError,
+			CreatedAt:      m.CreatedAt,
+			DeliveredAt:    m.DeliveredAt,
+		}
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
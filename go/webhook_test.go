@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+func newTestWebhookDispatcher(t *testing.T, client *http.Client) (*WebhookDispatcher, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return &WebhookDispatcher{
+		db:     sqlx.NewDb(db, "mysql"),
+		client: client,
+		logger: echo.New().Logger,
+	}, mock
+}
+
+func newTestWebhookDeliveryJob(url string, attempts int64) webhookDeliveryJob {
+	return webhookDeliveryJob{
+		WebhookDeliveryModel: WebhookDeliveryModel{
+			ID:        42,
+			WebhookID: 7,
+			Event:     WebhookEventReactionCreated,
+			Payload:   `{"event":"reaction.created","created_at":1700000000,"data":{}}`,
+			Status:    WebhookDeliveryPending,
+			Attempts:  attempts,
+		},
+		URL:    url,
+		Secret: "secret",
+	}
+}
+
+// from+intervalのUnix時刻か (実行にかかった時間の分だけ遅れてもよい)
+type unixTimeAfter struct {
+	from     time.Time
+	interval time.Duration
+}
+
+func (a unixTimeAfter) Match(v driver.Value) bool {
+	got, ok := v.(int64)
+	if !ok {
+		return false
+	}
+	want := a.from.Add(a.interval).Unix()
+	return want <= got && got <= want+2
+}
+
+func TestWebhookDispatcherDeliverSignsPayload(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	ch := make(chan received, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ch <- received{header: r.Header.Clone(), body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	d, _ := newTestWebhookDispatcher(t, server.Client())
+	job := newTestWebhookDeliveryJob(server.URL, 0)
+
+	statusCode, err := d.deliver(context.Background(), job)
+	if err != nil {
+		t.Fatalf("deliver failed: %v", err)
+	}
+	if statusCode != http.StatusNoContent {
+		t.Errorf("status code = %d, want %d", statusCode, http.StatusNoContent)
+	}
+
+	got := <-ch
+	if string(got.body) != job.Payload {
+		t.Errorf("body = %s, want %s", got.body, job.Payload)
+	}
+	if v := got.header.Get(webhookEventHeader); v != job.Event {
+		t.Errorf("%s = %q, want %q", webhookEventHeader, v, job.Event)
+	}
+	if v := got.header.Get(webhookDeliveryHeader); v != "42" {
+		t.Errorf("%s = %q, want %q", webhookDeliveryHeader, v, "42")
+	}
+	timestamp, err := strconv.ParseInt(got.header.Get(webhookTimestampHeader), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid %s: %v", webhookTimestampHeader, err)
+	}
+	if v, want := got.header.Get(webhookSignatureHeader), signWebhookPayload(job.Secret, timestamp, got.body); v != want {
+		t.Errorf("%s = %q, want %q", webhookSignatureHeader, v, want)
+	}
+}
+
+func TestWebhookDispatcherDeliverUnexpectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	d, _ := newTestWebhookDispatcher(t, server.Client())
+	statusCode, err := d.deliver(context.Background(), newTestWebhookDeliveryJob(server.URL, 0))
+	if err == nil {
+		t.Fatal("deliver succeeded for 500 response")
+	}
+	if statusCode != http.StatusInternalServerError {
+		t.Errorf("status code = %d, want %d", statusCode, http.StatusInternalServerError)
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a loopback server")
+	}))
+	defer server.Close()
+
+	d, _ := newTestWebhookDispatcher(t, newWebhookClient())
+	if _, err := d.deliver(context.Background(), newTestWebhookDeliveryJob(server.URL, 0)); err == nil {
+		t.Fatal("deliver to loopback address succeeded")
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":          true,
+		"2606:2800:220:1::":      true,
+		"127.0.0.1":              false,
+		"10.1.2.3":               false,
+		"172.31.255.255":         false,
+		"192.168.0.1":            false,
+		"169.254.169.254":        false,
+		"100.64.0.1":             false,
+		"0.1.2.3":                false,
+		"192.0.0.170":            false,
+		"198.18.0.1":             false,
+		"240.0.0.1":              false,
+		"255.255.255.255":        false,
+		"::1":                    false,
+		"::ffff:127.0.0.1":       false,
+		"::ffff:169.254.169.254": false,
+		"fd00::1":                false,
+		"fe80::1%eth0":           false,
+	}
+	for address, want := range tests {
+		if got := isPublicIP(netip.MustParseAddr(address)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestWebhookRetryInterval(t *testing.T) {
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second, 320 * time.Second}
+	for i, interval := range want {
+		if got := webhookRetryInterval(int64(i + 1)); got != interval {
+			t.Errorf("webhookRetryInterval(%d) = %s, want %s", i+1, got, interval)
+		}
+	}
+	if got := webhookRetryInterval(100); got != webhookRetryMaxInterval {
+		t.Errorf("webhookRetryInterval(100) = %s, want %s", got, webhookRetryMaxInterval)
+	}
+}
+
+func TestWebhookDispatcherRecordSuccess(t *testing.T) {
+	d, mock := newTestWebhookDispatcher(t, nil)
+	job := newTestWebhookDeliveryJob("http://example.com", 2)
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status_code = ?, last_error = NULL, delivered_at = ? WHERE id = ? AND status = ? AND attempts = ?")).
+		WithArgs(WebhookDeliverySucceeded, 3, 200, unixTimeAfter{from: time.Now()}, job.ID, WebhookDeliveryPending, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := d.record(context.Background(), job, http.StatusOK, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookDispatcherRecordRetriesThenGivesUp(t *testing.T) {
+	for attempts := int64(0); attempts < maxWebhookDeliveryAttempts; attempts++ {
+		d, mock := newTestWebhookDispatcher(t, nil)
+		job := newTestWebhookDeliveryJob("http://example.com", attempts)
+
+		status := WebhookDeliveryPending
+		if attempts+1 == maxWebhookDeliveryAttempts {
+			status = WebhookDeliveryFailed
+		}
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_status_code = ?, last_error = ? WHERE id = ? AND status = ? AND attempts = ?")).
+			WithArgs(status, attempts+1, unixTimeAfter{from: time.Now(), interval: webhookRetryInterval(attempts + 1)}, nil, "connection refused", job.ID, WebhookDeliveryPending, attempts).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		if err := d.record(context.Background(), job, 0, errors.New("connection refused")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWebhookDispatcherClaim(t *testing.T) {
+	d, mock := newTestWebhookDispatcher(t, nil)
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT d\.\*, w\.url, w\.secret\s+FROM webhook_deliveries d\s+INNER JOIN webhooks w ON w\.id = d\.webhook_id\s+WHERE d\.status = \? AND d\.next_attempt_at <= \?.*FOR UPDATE SKIP LOCKED`).
+		WithArgs(WebhookDeliveryPending, unixTimeAfter{from: now}, webhookBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "webhook_id", "event", "payload", "status", "attempts", "next_attempt_at", "last_status_code", "last_error", "created_at", "delivered_at", "url", "secret"}).
+			AddRow(1, 7, WebhookEventReactionCreated, "{}", WebhookDeliveryPending, 0, now.Unix(), nil, nil, now.Unix(), nil, "http://example.com/a", "s1").
+			AddRow(2, 7, WebhookEventReactionCreated, "{}", WebhookDeliveryPending, 3, now.Unix(), 500, "boom", now.Unix(), nil, "http://example.com/a", "s1"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id IN (?, ?)")).
+		WithArgs(unixTimeAfter{from: now, interval: webhookDeliveryLease}, 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	jobs, err := d.claim(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("claimed %d jobs, want 2", len(jobs))
+	}
+	for _, job := range jobs {
+		if job.URL != "http://example.com/a" || job.Secret != "s1" {
+			t.Errorf("job %d has url=%q secret=%q", job.ID, job.URL, job.Secret)
+		}
+		if !(unixTimeAfter{from: now, interval: webhookDeliveryLease}).Match(job.LeasedUntil) {
+			t.Errorf("job %d is leased until %d", job.ID, job.LeasedUntil)
+		}
+	}
+	if jobs[1].Attempts != 3 {
+		t.Errorf("attempts = %d, want 3", jobs[1].Attempts)
+	}
+}
+
+func TestWebhookDispatcherDispatchPendingSkipsReclaimedJob(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	d, mock := newTestWebhookDispatcher(t, server.Client())
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT d.*").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "webhook_id", "event", "payload", "status", "attempts", "next_attempt_at", "last_status_code", "last_error", "created_at", "delivered_at", "url", "secret"}).
+			AddRow(1, 7, WebhookEventReactionCreated, "{}", WebhookDeliveryPending, 0, now.Unix(), nil, nil, now.Unix(), nil, server.URL, "s1").
+			AddRow(2, 7, WebhookEventReactionCreated, "{}", WebhookDeliveryPending, 0, now.Unix(), nil, nil, now.Unix(), nil, server.URL, "s1"))
+	mock.ExpectExec("UPDATE webhook_deliveries SET next_attempt_at").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	// 1件目は送信する
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM webhook_deliveries WHERE id = ? AND status = ? AND attempts = ? AND next_attempt_at = ?")).
+		WithArgs(1, WebhookDeliveryPending, 0, unixTimeAfter{from: now, interval: webhookDeliveryLease}).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(1))
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = ").
+		WithArgs(WebhookDeliverySucceeded, 1, 200, sqlmock.AnyArg(), 1, WebhookDeliveryPending, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// 2件目は他のワーカーが取り出し直したので送らない
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM webhook_deliveries WHERE id = ?")).
+		WithArgs(2, WebhookDeliveryPending, 0, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(0))
+
+	if err := d.DispatchPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("sent %d requests, want 1", requests)
+	}
+}
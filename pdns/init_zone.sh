@@ -7,6 +7,11 @@ if test -f /home/isucon/env.sh; then
 	. /home/isucon/env.sh
 fi
 
+# PowerDNSを使わない (組み込みDNSサーバを使う) 場合はゾーンを読み込まない
+if [ "${ISUCON13_POWERDNS_DISABLED:-false}" = "true" ]; then
+	exit 0
+fi
+
 ISUCON_SUBDOMAIN_ADDRESS=${ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS:-127.0.0.1}
 
 temp_dir=$(mktemp -d)
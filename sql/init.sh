@@ -56,11 +56,28 @@ mysql -u"$ISUCON_DB_USER" \
 		--port "$ISUCON_DB_PORT" \
 		"$ISUCON_DB_NAME" < initial_livestream_tags.sql
 
+# 予約枠を生成する
+# 環境変数がセットされていなければ、アプリケーションのデフォルトと同じく
+# 2023/11/25 10:00からの１年間、1時間5枠
+RESERVATION_SLOT_SECONDS=${ISUCON13_RESERVATION_SLOT_SECONDS:-3600}
+RESERVATION_SLOT_CAPACITY=${ISUCON13_RESERVATION_SLOT_CAPACITY:-5}
+RESERVATION_TERM_START_AT=$(date -u -d "${ISUCON13_RESERVATION_TERM_START_AT:-2023-11-25T01:00:00Z}" +%s)
+RESERVATION_TERM_END_AT=$(date -u -d "${ISUCON13_RESERVATION_TERM_END_AT:-2024-11-25T01:00:00Z}" +%s)
+
 mysql -u"$ISUCON_DB_USER" \
 		-p"$ISUCON_DB_PASSWORD" \
 		--host "$ISUCON_DB_HOST" \
 		--port "$ISUCON_DB_PORT" \
-		"$ISUCON_DB_NAME" < initial_reservation_slots.sql
+		"$ISUCON_DB_NAME" <<EOS
+SET SESSION cte_max_recursion_depth = 10000000;
+INSERT INTO reservation_slots (slot, start_at, end_at)
+WITH RECURSIVE slots (start_at) AS (
+	SELECT ${RESERVATION_TERM_START_AT}
+	UNION ALL
+	SELECT start_at + ${RESERVATION_SLOT_SECONDS} FROM slots WHERE start_at + ${RESERVATION_SLOT_SECONDS} * 2 <= ${RESERVATION_TERM_END_AT}
+)
+SELECT ${RESERVATION_SLOT_CAPACITY}, start_at, start_at + ${RESERVATION_SLOT_SECONDS} FROM slots;
+EOS
 
 mysql -u"$ISUCON_DB_USER" \
 		-p"$ISUCON_DB_PASSWORD" \
@@ -12,9 +12,14 @@
 -- TRUNCATE TABLE users;
 
 ALTER TABLE `themes` auto_increment = 1;
+ALTER TABLE `notifications` auto_increment = 1;
+ALTER TABLE `webhooks` auto_increment = 1;
+ALTER TABLE `webhook_deliveries` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
+ALTER TABLE `follows` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
+ALTER TABLE `livestream_collaborators` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
 ALTER TABLE `livecomment_reports` auto_increment = 1;
 ALTER TABLE `ng_words` auto_increment = 1;
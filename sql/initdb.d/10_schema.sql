@@ -7,7 +7,10 @@ CREATE TABLE `users` (
   `display_name` VARCHAR(255) NOT NULL,
   `password` VARCHAR(255) NOT NULL,
   `description` TEXT NOT NULL,
-  UNIQUE `uniq_user_name` (`name`)
+  `deleted_at` BIGINT NULL,
+  UNIQUE `uniq_user_name` (`name`),
+  -- サブドメインとして使うため、大文字・小文字を区別せずに一意とする
+  UNIQUE `uniq_user_name_lower` ((LOWER(`name`)))
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- プロフィール画像
@@ -27,6 +30,29 @@ CREATE TABLE `themes` (
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 ALTER TABLE `themes` ADD FOREIGN KEY `themes_user_id` (`user_id`) REFERENCES `users` (`id`);
 
+-- ログイン中のセッション (id はクッキーのSESSIONID)
+CREATE TABLE `user_sessions` (
+  `id` VARCHAR(36) NOT NULL PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `user_agent` VARCHAR(1024) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  `revoked_at` BIGINT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX user_sessions_user_id ON user_sessions(`user_id`);
+
+-- ユーザのフォロー関係 (follower_id が followee_id をフォローしている)
+CREATE TABLE `follows` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `follower_id` BIGINT NOT NULL,
+  `followee_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_follow` (`follower_id`, `followee_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX follows_followee_id ON follows(`followee_id`);
+ALTER TABLE `follows` ADD FOREIGN KEY `follows_follower_id` (`follower_id`) REFERENCES `users` (`id`);
+ALTER TABLE `follows` ADD FOREIGN KEY `follows_followee_id` (`followee_id`) REFERENCES `users` (`id`);
+
 -- ライブ配信
 CREATE TABLE `livestreams` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -53,6 +79,7 @@ CREATE TABLE `reservation_slots` (
 CREATE TABLE `tags` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `name` VARCHAR(255) NOT NULL,
+  `retired` BOOLEAN NOT NULL DEFAULT FALSE,
   UNIQUE `uniq_tag_name` (`name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
@@ -64,6 +91,17 @@ CREATE TABLE `livestream_tags` (
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 ALTER TABLE `livestream_tags` ADD FOREIGN KEY `livestream_tags_livestream_id` (`livestream_id`) REFERENCES `livestreams` (`id`);
 
+-- ライブ配信のコラボレーター
+CREATE TABLE `livestream_collaborators` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_collaborator` (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX livestream_collaborators_user_id ON livestream_collaborators(`user_id`);
+ALTER TABLE `livestream_collaborators` ADD FOREIGN KEY `livestream_collaborators_livestream_id` (`livestream_id`) REFERENCES `livestreams` (`id`);
+ALTER TABLE `livestream_collaborators` ADD FOREIGN KEY `livestream_collaborators_user_id` (`user_id`) REFERENCES `users` (`id`);
+
 -- ライブ配信視聴履歴
 CREATE TABLE `livestream_viewers_history` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -86,6 +124,7 @@ CREATE TABLE `livecomments` (
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 ALTER TABLE `livecomments` ADD FOREIGN KEY `livecomments_user_id` (`user_id`) REFERENCES `users` (`id`);
 ALTER TABLE `livecomments` ADD FOREIGN KEY `livecomments_livestream_id` (`livestream_id`) REFERENCES `livestreams` (`id`);
+CREATE INDEX livecomments_livestream_id_created_at_id ON livecomments(`livestream_id`, `created_at`, `id`);
 
 -- ユーザからのライブコメントのスパム報告
 CREATE TABLE `livecomment_reports` (
@@ -121,3 +160,64 @@ CREATE TABLE `reactions` (
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 ALTER TABLE `reactions` ADD FOREIGN KEY `reactions_user_id` (`user_id`) REFERENCES `users` (`id`);
 ALTER TABLE `reactions` ADD FOREIGN KEY `reactions_livestream_id` (`livestream_id`) REFERENCES `livestreams` (`id`);
+CREATE INDEX reactions_livestream_id_created_at_id ON reactions(`livestream_id`, `created_at`, `id`);
+
+-- ユーザへの通知
+-- livestream_id, livecomment_id, actor_user_id は該当しない場合0
+CREATE TABLE `notifications` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `type` VARCHAR(64) NOT NULL,
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `livecomment_id` BIGINT NOT NULL DEFAULT 0,
+  `actor_user_id` BIGINT NOT NULL DEFAULT 0,
+  `read_at` BIGINT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_notification` (`user_id`, `type`, `livestream_id`, `livecomment_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX notifications_user_id_read_at ON notifications(`user_id`, `read_at`);
+
+-- 配信者の配信を視聴したことのあるユーザ (配信開始通知の宛先)
+-- livestream_viewers_historyは退出時に消えるので、別に残しておく
+CREATE TABLE `streamer_viewers` (
+  `streamer_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`streamer_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX streamer_viewers_user_id ON streamer_viewers(`user_id`);
+
+-- 定期的な通知の作成がどこまで済んだか
+CREATE TABLE `notification_watermarks` (
+  `name` VARCHAR(64) NOT NULL PRIMARY KEY,
+  `checked_until` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者が登録したWebhook
+-- events はカンマ区切りのイベント名
+CREATE TABLE `webhooks` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `url` VARCHAR(2048) NOT NULL,
+  `secret` VARCHAR(255) NOT NULL,
+  `events` VARCHAR(1024) NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX webhooks_user_id ON webhooks(`user_id`);
+
+-- Webhookの配送キュー兼配送ログ
+CREATE TABLE `webhook_deliveries` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `webhook_id` BIGINT NOT NULL,
+  `event` VARCHAR(64) NOT NULL,
+  `payload` MEDIUMTEXT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `attempts` BIGINT NOT NULL DEFAULT 0,
+  `next_attempt_at` BIGINT NOT NULL,
+  `last_status_code` BIGINT NULL,
+  `last_error` TEXT NULL,
+  `created_at` BIGINT NOT NULL,
+  `delivered_at` BIGINT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX webhook_deliveries_status_next_attempt_at ON webhook_deliveries(`status`, `next_attempt_at`);
+CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries(`webhook_id`);
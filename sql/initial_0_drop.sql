@@ -1,11 +1,19 @@
 drop TABLE IF EXISTS themes;
+drop TABLE IF EXISTS notifications;
+drop TABLE IF EXISTS streamer_viewers;
+drop TABLE IF EXISTS notification_watermarks;
+drop TABLE IF EXISTS webhook_deliveries;
+drop TABLE IF EXISTS webhooks;
 drop TABLE IF EXISTS icons;
+drop TABLE IF EXISTS follows;
+drop TABLE IF EXISTS user_sessions;
 drop TABLE IF EXISTS reservation_slots;
 drop TABLE IF EXISTS livestream_viewers_history;
 drop TABLE IF EXISTS livecomment_reports;
 drop TABLE IF EXISTS ng_words;
 drop TABLE IF EXISTS reactions;
 drop TABLE IF EXISTS livestream_tags;
+drop TABLE IF EXISTS livestream_collaborators;
 drop TABLE IF EXISTS tags;
 drop TABLE IF EXISTS livecomments;
 drop TABLE IF EXISTS livestreams;